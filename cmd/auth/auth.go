@@ -1,32 +1,590 @@
 package main
 
 import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/endophage/quotivational/config"
+	"github.com/endophage/quotivational/serve"
 	"github.com/gorilla/mux"
 )
 
-// NewAuthHandler returns a server handler for authentication
-func NewAuthHandler(goodTokens []string) http.Handler {
-	goodTokensByID := make(map[string]bool)
-	for _, token := range goodTokens {
-		goodTokensByID[token] = true
+// seedLabel is the label given to tokens passed on the command line
+const seedLabel = "command line"
+
+// defaultRotationGrace is how long a token stays valid after it is rotated,
+// unless the rotate request says otherwise
+const defaultRotationGrace = time.Hour
+
+// pepperEnv is the environment variable the pepper is read from by default,
+// which keeps it out of the process list
+const pepperEnv = "AUTH_TOKEN_PEPPER"
+
+// defaultCacheMaxAge is how long the quote server may cache a successful
+// verification by default
+const defaultCacheMaxAge = 30 * time.Second
+
+// negativeCacheMaxAge is the longest the quote server may cache a failed
+// verification, kept short so new tokens start working quickly
+const negativeCacheMaxAge = 5 * time.Second
+
+// purgeTimeout bounds how long telling a quote server to purge a revoked
+// token from its cache may take
+const purgeTimeout = 5 * time.Second
+
+// expiresInHeader is the response header giving the number of seconds a
+// token has left, for tokens that expire
+const expiresInHeader = "X-Token-Expires-In"
+
+// tokenInfo describes a token in a listing
+type tokenInfo struct {
+	ID        int64
+	Label     string
+	Scopes    []string
+	Signed    bool `json:",omitempty"`
+	Created   time.Time
+	NotBefore *time.Time `json:",omitempty"`
+	Expires   *time.Time `json:",omitempty"`
+	Retired   *time.Time `json:",omitempty"`
+	Revoked   *time.Time `json:",omitempty"`
+}
+
+func newTokenInfo(tok *Token) tokenInfo {
+	return tokenInfo{
+		ID:        tok.ID,
+		Label:     tok.Label,
+		Scopes:    tok.ScopeList(),
+		Signed:    tok.Signed,
+		Created:   tok.Created,
+		NotBefore: timeOrNil(tok.NotBefore),
+		Expires:   timeOrNil(tok.Expires),
+		Retired:   timeOrNil(tok.Retired),
+		Revoked:   timeOrNil(tok.Revoked),
+	}
+}
+
+// timeOrNil returns nil for the zero time, so it is left out of responses
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
 	}
+	return &t
+}
+
+// issuedToken is the response to issuing a token, the only time the token
+// itself is ever returned
+type issuedToken struct {
+	tokenInfo
+	Token string
+}
 
+// tokenRequest is the body of a request to issue a token. Scopes, NotBefore
+// and Expires are optional. Signed asks for a signed token, which the quote
+// server can check without asking the auth server.
+type tokenRequest struct {
+	Label     string
+	Scopes    []string
+	NotBefore time.Time
+	Expires   time.Time
+	Signed    bool
+}
+
+// verifyRequest is the body of a request to verify a token, for callers that
+// don't send it as the x-auth-token header
+type verifyRequest struct {
+	Token string
+}
+
+// verifyResponse is the body of the response to verifying a valid token
+type verifyResponse struct {
+	ID     int64
+	Scopes []string
+}
+
+// purgeSecretHeader is the header the purge secret is sent to quote servers in
+const purgeSecretHeader = "X-Purge-Secret"
+
+// purgeRequest is the body sent to quote servers to have them forget what
+// they have cached about a revoked token
+type purgeRequest struct {
+	ID int64
+}
+
+// AuthConfig configures the auth handler
+type AuthConfig struct {
+	// AdminToken may use the admin endpoints, as may tokens with the
+	// tokens:admin scope
+	AdminToken string
+
+	// RotationGrace is how long rotated tokens stay valid unless the
+	// request asks for another period
+	RotationGrace time.Duration
+
+	// CacheMaxAge is how long callers may cache a successful verification.
+	// It is never longer than the token has left.
+	CacheMaxAge time.Duration
+
+	// PurgeURLs are the quote servers to tell when a token is revoked, so
+	// they drop it from their caches straight away
+	PurgeURLs []string
+
+	// PurgeSecret is sent with each purge, since quote servers only purge
+	// when asked with the secret they were given
+	PurgeSecret string
+}
+
+// withdrawnToken is a signed token that stops being valid before the expiry
+// it carries. ID is the token's jti claim.
+type withdrawnToken struct {
+	ID    string
+	Until time.Time
+}
+
+// withdrawnList is the response listing withdrawn signed tokens
+type withdrawnList struct {
+	Withdrawn []withdrawnToken
+}
+
+// rotateRequest is the optional body of a request to rotate a token. Grace
+// is a duration such as "30m".
+type rotateRequest struct {
+	Grace string
+}
+
+// NewAuthHandler returns a server handler for authentication
+func NewAuthHandler(store *TokenStore, config AuthConfig) http.Handler {
 	m := mux.NewRouter()
-	m.Methods("GET").Path("/token/{token:.+}").Handler(
+	m.Methods("POST").Path("/token/verify").Handler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := r.Header.Get("x-auth-token")
+			if token == "" {
+				req := &verifyRequest{}
+				if err := json.NewDecoder(r.Body).Decode(req); err != nil && err != io.EOF {
+					http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+				token = req.Token
+			}
+			checkToken(w, store, token, config.CacheMaxAge)
+		}))
+	m.Methods("GET").Path("/healthz").HandlerFunc(liveHandler)
+	m.Methods("GET").Path("/readyz").HandlerFunc(readyHandler(store))
+	m.Methods("GET").Path("/.well-known/jwks.json").Handler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			keys := &jwkSet{Keys: []jwk{}}
+			if store.signer != nil {
+				keys = store.signer.KeySet()
+			}
+			writeJSON(w, http.StatusOK, keys)
+		}))
+	m.Methods("GET").Path("/.well-known/revoked.json").Handler(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			vars := mux.Vars(r)
-			if _, ok := goodTokensByID[vars["token"]]; !ok {
-				w.WriteHeader(http.StatusUnauthorized)
+			tokens, err := store.Withdrawn()
+			if err != nil {
+				fmt.Println("error listing withdrawn tokens: ", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			list := &withdrawnList{Withdrawn: make([]withdrawnToken, 0, len(tokens))}
+			for _, tok := range tokens {
+				list.Withdrawn = append(list.Withdrawn, withdrawnToken{
+					ID:    strconv.FormatInt(tok.ID, 10),
+					Until: tok.ValidUntil(),
+				})
 			}
+			writeJSON(w, http.StatusOK, list)
 		}))
+	// the token ends up in access logs this way, so /token/verify is
+	// preferred, but this stays for older callers
+	m.Methods("GET").Path("/token/{token:.+}").Handler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			checkToken(w, store, mux.Vars(r)["token"], config.CacheMaxAge)
+		}))
+
+	a := &adminHandlers{store: store, config: config}
+	m.Methods("POST").Path("/tokens").HandlerFunc(a.IssueTokenHandler)
+	m.Methods("GET").Path("/tokens").HandlerFunc(a.ListTokensHandler)
+	m.Methods("POST").Path("/tokens/{id:[0-9]+}/rotate").HandlerFunc(a.RotateTokenHandler)
+	m.Methods("DELETE").Path("/tokens/{id:[0-9]+}").HandlerFunc(a.RevokeTokenHandler)
 
 	return m
 }
 
+// checkToken responds with a 200 and the token's scopes if it is valid and a
+// 401 if not, along with how long it has left if it expires and how long the
+// answer may be cached for
+func checkToken(w http.ResponseWriter, store *TokenStore, token string, maxAge time.Duration) {
+	unauthorized := func() {
+		setMaxAge(w, maxAge, negativeCacheMaxAge)
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	if token == "" {
+		unauthorized()
+		return
+	}
+	tok, err := store.Lookup(token)
+	if err == errNoSuchToken {
+		unauthorized()
+		return
+	}
+	if err != nil {
+		fmt.Println("error checking token: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	if !tok.ValidAt(now) {
+		unauthorized()
+		return
+	}
+	if until := tok.ValidUntil(); !until.IsZero() {
+		left := until.Sub(now)
+		w.Header().Set(expiresInHeader, strconv.FormatInt(int64(left/time.Second), 10))
+		setMaxAge(w, maxAge, left)
+	} else {
+		setMaxAge(w, maxAge, maxAge)
+	}
+	writeJSON(w, http.StatusOK, &verifyResponse{ID: tok.ID, Scopes: tok.ScopeList()})
+}
+
+// setMaxAge sets the Cache-Control header to allow caching for whichever of
+// the two ages is shorter
+func setMaxAge(w http.ResponseWriter, maxAge, limit time.Duration) {
+	if limit < maxAge {
+		maxAge = limit
+	}
+	if seconds := int64(maxAge / time.Second); seconds > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", seconds))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+}
+
+// purgeCaches tells the quote servers to forget what they have cached about
+// the token. It's done in the background, since the revocation has already
+// happened and the caches expire on their own anyway.
+func purgeCaches(urls []string, secret string, id int64) {
+	body, err := json.Marshal(&purgeRequest{ID: id})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	client := &http.Client{Timeout: purgeTimeout}
+	for _, url := range urls {
+		go func(url string) {
+			req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+			if err != nil {
+				fmt.Println("error purging token from ", url, ": ", err)
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(purgeSecretHeader, secret)
+			resp, err := client.Do(req)
+			if err != nil {
+				fmt.Println("error purging token from ", url, ": ", err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				fmt.Println("error purging token from ", url, ": ", resp.Status)
+			}
+		}(url)
+	}
+}
+
+// adminHandlers serves the endpoints for managing tokens
+type adminHandlers struct {
+	store  *TokenStore
+	config AuthConfig
+}
+
+// authorized checks the request carries the admin token or a token with the
+// tokens:admin scope, writing out a 401 or 403 and returning false if it
+// doesn't
+func (a *adminHandlers) authorized(w http.ResponseWriter, r *http.Request) bool {
+	key := r.Header.Get("x-auth-token")
+	if key == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	adminToken := a.config.AdminToken
+	if adminToken != "" && subtle.ConstantTimeCompare([]byte(key), []byte(adminToken)) == 1 {
+		return true
+	}
+
+	tok, err := a.store.Lookup(key)
+	switch {
+	case err == errNoSuchToken:
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	case err != nil:
+		fmt.Println("error checking token: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	case !tok.ValidAt(time.Now()):
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	case !tok.HasScope(scopeTokensAdmin):
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// IssueTokenHandler is the handler that creates a new token with the label,
+// and optionally the scopes, validity period and kind, given in the request
+// body
+func (a *adminHandlers) IssueTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(w, r) {
+		return
+	}
+	req := &tokenRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateScopes(req.Scopes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !req.Expires.IsZero() {
+		if !req.Expires.After(time.Now()) || !req.Expires.After(req.NotBefore) {
+			http.Error(w, "Expires must be in the future and after NotBefore", http.StatusBadRequest)
+			return
+		}
+	}
+	tok := &Token{
+		Label:     req.Label,
+		Scopes:    joinScopes(req.Scopes),
+		NotBefore: req.NotBefore,
+		Expires:   req.Expires,
+		Signed:    req.Signed,
+	}
+	secret, err := a.store.Issue(tok)
+	if err == errNoSigner {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		fmt.Println("error issuing token: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeIssuedToken(w, tok, secret)
+}
+
+// RotateTokenHandler is the handler that issues a replacement for a token.
+// The old token stays valid for the grace period, and then expires.
+func (a *adminHandlers) RotateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(w, r) {
+		return
+	}
+	grace := a.config.RotationGrace
+	req := &rotateRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil && err != io.EOF {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Grace != "" {
+		var err error
+		grace, err = time.ParseDuration(req.Grace)
+		if err != nil || grace < 0 {
+			http.Error(w, "Grace must be a duration such as 30m", http.StatusBadRequest)
+			return
+		}
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	tok, secret, err := a.store.Rotate(id, grace)
+	switch {
+	case err == errNoSuchToken:
+		w.WriteHeader(http.StatusNotFound)
+	case err == errTokenInvalid, err == errNoSigner:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		fmt.Println("error rotating token: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	default:
+		// cached verifications may outlive the old token's grace period
+		purgeCaches(a.config.PurgeURLs, a.config.PurgeSecret, id)
+		writeIssuedToken(w, tok, secret)
+	}
+}
+
+// writeIssuedToken responds with a token that has just been created
+func writeIssuedToken(w http.ResponseWriter, tok *Token, secret string) {
+	w.Header().Set("Location", fmt.Sprintf("/tokens/%d", tok.ID))
+	writeJSON(w, http.StatusCreated, &issuedToken{tokenInfo: newTokenInfo(tok), Token: secret})
+}
+
+// ListTokensHandler is the handler that lists every token that has been
+// issued, without the tokens themselves
+func (a *adminHandlers) ListTokensHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(w, r) {
+		return
+	}
+	tokens, err := a.store.List()
+	if err != nil {
+		fmt.Println("error listing tokens: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	infos := make([]tokenInfo, 0, len(tokens))
+	for i := range tokens {
+		infos = append(infos, newTokenInfo(&tokens[i]))
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// RevokeTokenHandler is the handler that stops a token from being accepted
+func (a *adminHandlers) RevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(w, r) {
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err == nil {
+		err = a.store.Revoke(id)
+	}
+	switch {
+	case err == errNoSuchToken:
+		w.WriteHeader(http.StatusNotFound)
+	case err != nil:
+		fmt.Println("error revoking token: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	default:
+		purgeCaches(a.config.PurgeURLs, a.config.PurgeSecret, id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// writeJSON writes out v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
 func main() {
-	flag.Parse()
-	http.ListenAndServe(":8081", NewAuthHandler(flag.Args()))
+	var dbtype = flag.String("dbtype", "sqlite3", "The DB driver, sqlite3 or mysql")
+	var dbsource = flag.String("db", "auth.db", "The DB source")
+	var adminToken = flag.String("admin-token", "", "The token that may manage other tokens")
+	var pepper = flag.String("pepper", "",
+		"The secret tokens are hashed with; changing it invalidates every token. Best set with $"+pepperEnv)
+	var signingKey = flag.String("signing-key", "",
+		"A file holding the Ed25519 key signed tokens are signed with, created if it doesn't exist. "+
+			"Signed tokens are only issued if this is set")
+	var signedTTL = flag.Duration("signed-ttl", defaultSignedTTL, "How long signed tokens last by default")
+	var rotationGrace = flag.Duration("rotation-grace", defaultRotationGrace,
+		"How long a rotated token stays valid")
+	var cacheMaxAge = flag.Duration("cache-max-age", defaultCacheMaxAge,
+		"How long quote servers may cache a token's verification")
+	var purge = flag.String("purge", "",
+		"Comma separated URLs of quote servers to tell when a token is revoked, "+
+			"such as http://server:8080/authcache/purge")
+	var purgeSecret = flag.String("purge-secret", "",
+		"The secret quote servers were given to authenticate purges with. Needed with -purge")
+	var tokens config.Strings
+	flag.Var(&tokens, "token", "A token to add with the default scopes. May be repeated, "+
+		"and tokens may also be given as arguments")
+	var serveConfig serve.Config
+	serveConfig.RegisterFlags(flag.CommandLine, ":8081")
+
+	settings, err := config.Load(flag.CommandLine, os.Args[1:], config.Options{
+		EnvPrefix: "AUTH",
+		Env:       map[string]string{"pepper": pepperEnv},
+		Secret:    []string{"db", "admin-token", "pepper", "token", "purge-secret"},
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if settings.PrintRequested() {
+		settings.Print(os.Stdout)
+		return
+	}
+	if *dbtype != "sqlite3" && *dbtype != "mysql" {
+		fmt.Fprintf(os.Stderr, "dbtype must be sqlite3 or mysql, not %q\n", *dbtype)
+		os.Exit(2)
+	}
+	if err := settings.Require("db"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *purge != "" {
+		if err := settings.Require("purge-secret"); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	if *pepper == "" {
+		fmt.Println("warning: no pepper set, tokens are hashed without a secret")
+	}
+
+	stop := serve.StopOnSignal()
+	var store *TokenStore
+	for {
+		store, err = NewTokenStore(*dbtype, *dbsource, *pepper)
+		if err == nil {
+			break
+		}
+		fmt.Println(err.Error())
+		select {
+		case <-stop:
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+	defer store.Close()
+
+	if *signingKey != "" {
+		key, err := LoadSigningKey(*signingKey)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		store.SetSigner(NewSigner(key, *signedTTL))
+	}
+
+	// tokens given in the settings are added to the store with the default
+	// scopes, as are those given as arguments, so existing setups keep working
+	for _, token := range append(tokens, flag.Args()...) {
+		if _, err := store.Add(token, seedLabel, nil); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+	}
+
+	config := AuthConfig{
+		AdminToken:    *adminToken,
+		RotationGrace: *rotationGrace,
+		CacheMaxAge:   *cacheMaxAge,
+		PurgeSecret:   *purgeSecret,
+	}
+	if *purge != "" {
+		config.PurgeURLs = strings.Split(*purge, ",")
+	}
+	if err := serve.Serve(NewAuthHandler(store, config), serveConfig, stop); err != nil {
+		fmt.Println(err.Error())
+		store.Close()
+		os.Exit(1)
+	}
 }
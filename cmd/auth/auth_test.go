@@ -1,12 +1,30 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/go-xorm/xorm"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	testAdminToken = "admin"
+	testPepper     = "pepper"
 )
 
-func makeRequest(t *testing.T, baseURL, token string, expected int) {
+func makeRequest(t *testing.T, baseURL, token string, expected int) http.Header {
 	req, err := http.NewRequest("GET", baseURL+"/token/"+token, nil)
 	if err != nil {
 		t.Fatalf("expected no error setting up a request: %s", err)
@@ -19,13 +37,66 @@ func makeRequest(t *testing.T, baseURL, token string, expected int) {
 	if resp.StatusCode != expected {
 		t.Fatalf("expected a %v response, got %v", expected, resp.StatusCode)
 	}
+	return resp.Header
+}
+
+// makeAdminRequest sends a request to an admin endpoint with the given auth
+// token, decoding the response body into out if it isn't nil
+func makeAdminRequest(t *testing.T, method, url, token, body string, expected int, out interface{}) {
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("expected no error setting up a request: %s", err)
+	}
+	req.Header.Set("x-auth-token", token)
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("should not have gotten an error making a request: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expected {
+		t.Fatalf("expected a %v response to %s %s, got %v", expected, method, url, resp.StatusCode)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("expected a JSON response: %s", err)
+		}
+	}
+}
+
+func testConfig(adminToken string) AuthConfig {
+	return AuthConfig{
+		AdminToken:    adminToken,
+		RotationGrace: defaultRotationGrace,
+		CacheMaxAge:   defaultCacheMaxAge,
+	}
+}
+
+func setupStore(t *testing.T, dbfile string) *TokenStore {
+	store, err := NewTokenStore("sqlite3", dbfile, testPepper)
+	if err != nil {
+		t.Fatalf("expected no error setting up the token store: %s", err)
+	}
+	return store
 }
 
 func TestAuthHandler(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	store := setupStore(t, filepath.Join(tempDir, "db"))
+	defer store.Close()
+
 	goodTokens := []string{"goody", "two", "shoes"}
 	badTokens := []string{"baddy", "three", "boots"}
+	for _, tok := range goodTokens {
+		if _, err := store.Add(tok, seedLabel, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
 
-	s := httptest.NewServer(NewAuthHandler(goodTokens))
+	s := httptest.NewServer(NewAuthHandler(store, testConfig("")))
 
 	for _, tok := range goodTokens {
 		makeRequest(t, s.URL, tok, http.StatusOK)
@@ -35,3 +106,618 @@ func TestAuthHandler(t *testing.T) {
 		makeRequest(t, s.URL, tok, http.StatusUnauthorized)
 	}
 }
+
+func TestIssueListAndRevokeTokens(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	store := setupStore(t, filepath.Join(tempDir, "db"))
+	defer store.Close()
+
+	s := httptest.NewServer(NewAuthHandler(store, testConfig(testAdminToken)))
+	defer s.Close()
+
+	issued := make(map[string]interface{})
+	makeAdminRequest(t, "POST", s.URL+"/tokens", testAdminToken,
+		`{"Label": "kitchen display"}`, http.StatusCreated, &issued)
+	token, _ := issued["Token"].(string)
+	if token == "" || issued["Label"] != "kitchen display" || issued["Created"] == nil {
+		t.Fatalf("unexpected issued token: %v", issued)
+	}
+	makeRequest(t, s.URL, token, http.StatusOK)
+
+	var listed []map[string]interface{}
+	makeAdminRequest(t, "GET", s.URL+"/tokens", testAdminToken, "", http.StatusOK, &listed)
+	if len(listed) != 1 || listed[0]["Label"] != "kitchen display" {
+		t.Fatalf("unexpected token listing: %v", listed)
+	}
+	if _, ok := listed[0]["Token"]; ok {
+		t.Fatal("the listing should not include the token itself")
+	}
+	if _, ok := listed[0]["Revoked"]; ok {
+		t.Fatal("the token should not be revoked yet")
+	}
+
+	revokeURL := fmt.Sprintf("%s/tokens/%v", s.URL, issued["ID"])
+	makeAdminRequest(t, "DELETE", revokeURL, testAdminToken, "", http.StatusNoContent, nil)
+	makeRequest(t, s.URL, token, http.StatusUnauthorized)
+
+	makeAdminRequest(t, "GET", s.URL+"/tokens", testAdminToken, "", http.StatusOK, &listed)
+	if _, ok := listed[0]["Revoked"]; !ok {
+		t.Fatalf("the token should be listed as revoked: %v", listed)
+	}
+
+	makeAdminRequest(t, "DELETE", s.URL+"/tokens/1000", testAdminToken, "", http.StatusNotFound, nil)
+}
+
+func TestAdminEndpointsNeedAdminToken(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	store := setupStore(t, filepath.Join(tempDir, "db"))
+	defer store.Close()
+	tok, err := store.Add("user1", seedLabel, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := httptest.NewServer(NewAuthHandler(store, testConfig(testAdminToken)))
+	defer s.Close()
+
+	revokeURL := fmt.Sprintf("%s/tokens/%d", s.URL, tok.ID)
+	for token, status := range map[string]int{
+		"":      http.StatusUnauthorized,
+		"baddy": http.StatusUnauthorized,
+		"user1": http.StatusForbidden,
+	} {
+		makeAdminRequest(t, "POST", s.URL+"/tokens", token, `{}`, status, nil)
+		makeAdminRequest(t, "GET", s.URL+"/tokens", token, "", status, nil)
+		makeAdminRequest(t, "DELETE", revokeURL, token, "", status, nil)
+	}
+	makeRequest(t, s.URL, "user1", http.StatusOK)
+
+	// without an admin token only tokens with the tokens:admin scope can
+	// use the admin API
+	noAdmin := httptest.NewServer(NewAuthHandler(store, testConfig("")))
+	defer noAdmin.Close()
+	makeAdminRequest(t, "GET", noAdmin.URL+"/tokens", "", "", http.StatusUnauthorized, nil)
+}
+
+func TestTokensPersist(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	dbfile := filepath.Join(tempDir, "db")
+
+	store := setupStore(t, dbfile)
+	issued, err := store.Issue(&Token{Label: "laptop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeded, err := store.Add("user1", seedLabel, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store = setupStore(t, dbfile)
+	defer store.Close()
+	again, err := store.Add("user1", seedLabel, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != seeded.ID {
+		t.Fatalf("adding a stored token again should not create another, got IDs %d and %d",
+			seeded.ID, again.ID)
+	}
+	for _, token := range []string{issued, "user1"} {
+		tok, err := store.Lookup(token)
+		if err != nil || !tok.ValidAt(time.Now()) {
+			t.Fatalf("expected %q to still be valid, got %v, %v", token, tok, err)
+		}
+	}
+	tokens, err := store.List()
+	if err != nil || len(tokens) != 2 {
+		t.Fatalf("expected 2 tokens after reopening the store, got %v, %v", tokens, err)
+	}
+}
+
+func TestTokenValidityPeriod(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	store := setupStore(t, filepath.Join(tempDir, "db"))
+	defer store.Close()
+
+	s := httptest.NewServer(NewAuthHandler(store, testConfig(testAdminToken)))
+	defer s.Close()
+
+	now := time.Now()
+	forever, err := store.Issue(&Token{Label: "forever"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := store.Issue(&Token{Label: "expired",
+		NotBefore: now.Add(-2 * time.Hour), Expires: now.Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	future, err := store.Issue(&Token{Label: "future",
+		NotBefore: now.Add(time.Hour), Expires: now.Add(2 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := makeRequest(t, s.URL, forever, http.StatusOK)
+	if left := header.Get(expiresInHeader); left != "" {
+		t.Fatalf("a token that doesn't expire should have no lifetime header, got %q", left)
+	}
+	makeRequest(t, s.URL, expired, http.StatusUnauthorized)
+	makeRequest(t, s.URL, future, http.StatusUnauthorized)
+
+	issued := make(map[string]interface{})
+	body := fmt.Sprintf(`{"Label": "hour", "Expires": %q}`, now.Add(time.Hour).Format(time.RFC3339))
+	makeAdminRequest(t, "POST", s.URL+"/tokens", testAdminToken, body, http.StatusCreated, &issued)
+	if issued["Expires"] == nil {
+		t.Fatalf("expected the issued token to have an expiry: %v", issued)
+	}
+	header = makeRequest(t, s.URL, issued["Token"].(string), http.StatusOK)
+	left, err := strconv.Atoi(header.Get(expiresInHeader))
+	if err != nil || left <= 0 || left > 3600 {
+		t.Fatalf("expected up to an hour left on the token, got %q", header.Get(expiresInHeader))
+	}
+
+	body = fmt.Sprintf(`{"Label": "past", "Expires": %q}`, now.Add(-time.Hour).Format(time.RFC3339))
+	makeAdminRequest(t, "POST", s.URL+"/tokens", testAdminToken, body, http.StatusBadRequest, nil)
+}
+
+func TestRotateToken(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	store := setupStore(t, filepath.Join(tempDir, "db"))
+	defer store.Close()
+
+	s := httptest.NewServer(NewAuthHandler(store, testConfig(testAdminToken)))
+	defer s.Close()
+
+	oldTok := &Token{Label: "phone", Expires: time.Now().Add(24 * time.Hour)}
+	old, err := store.Issue(oldTok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotateURL := fmt.Sprintf("%s/tokens/%d/rotate", s.URL, oldTok.ID)
+
+	issued := make(map[string]interface{})
+	makeAdminRequest(t, "POST", rotateURL, testAdminToken, "", http.StatusCreated, &issued)
+	if issued["Label"] != "phone" || issued["Token"] == old {
+		t.Fatalf("expected a new token with the same label, got %v", issued)
+	}
+	makeRequest(t, s.URL, issued["Token"].(string), http.StatusOK)
+
+	// the old token is still good for the grace period
+	header := makeRequest(t, s.URL, old, http.StatusOK)
+	left, err := strconv.Atoi(header.Get(expiresInHeader))
+	if err != nil || left > int(defaultRotationGrace/time.Second) {
+		t.Fatalf("expected the old token to expire within the grace period, got %q",
+			header.Get(expiresInHeader))
+	}
+
+	// with no grace period the replacement takes over straight away
+	rotateURL = fmt.Sprintf("%s/tokens/%v/rotate", s.URL, issued["ID"])
+	makeAdminRequest(t, "POST", rotateURL, testAdminToken, `{"Grace": "0s"}`, http.StatusCreated, nil)
+	makeRequest(t, s.URL, issued["Token"].(string), http.StatusUnauthorized)
+	makeAdminRequest(t, "POST", rotateURL, testAdminToken, "", http.StatusConflict, nil)
+
+	makeAdminRequest(t, "POST", rotateURL, testAdminToken, `{"Grace": "soon"}`, http.StatusBadRequest, nil)
+	makeAdminRequest(t, "POST", s.URL+"/tokens/1000/rotate", testAdminToken, "", http.StatusNotFound, nil)
+}
+
+// makeVerifyRequest posts to /token/verify, with the token in the header if
+// it is given and the body otherwise
+func makeVerifyRequest(t *testing.T, baseURL, header, body string, expected int) {
+	req, err := http.NewRequest("POST", baseURL+"/token/verify", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("expected no error setting up a request: %s", err)
+	}
+	if header != "" {
+		req.Header.Set("x-auth-token", header)
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("should not have gotten an error making a request: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expected {
+		t.Fatalf("expected a %v response, got %v", expected, resp.StatusCode)
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	store := setupStore(t, filepath.Join(tempDir, "db"))
+	defer store.Close()
+	if _, err := store.Add("goody", seedLabel, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	s := httptest.NewServer(NewAuthHandler(store, testConfig("")))
+	defer s.Close()
+
+	makeVerifyRequest(t, s.URL, "goody", "", http.StatusOK)
+	makeVerifyRequest(t, s.URL, "", `{"Token": "goody"}`, http.StatusOK)
+	makeVerifyRequest(t, s.URL, "baddy", "", http.StatusUnauthorized)
+	makeVerifyRequest(t, s.URL, "", `{"Token": "baddy"}`, http.StatusUnauthorized)
+	makeVerifyRequest(t, s.URL, "", "", http.StatusUnauthorized)
+	makeVerifyRequest(t, s.URL, "", "{", http.StatusBadRequest)
+}
+
+func TestTokensStoredHashed(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	dbfile := filepath.Join(tempDir, "db")
+
+	// a database from before tokens were hashed
+	engine, err := xorm.NewEngine("sqlite3", dbfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.Sync2(&Token{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := engine.Insert(&Token{Hash: "user1", Label: seedLabel}); err != nil {
+		t.Fatal(err)
+	}
+	engine.Close()
+
+	store := setupStore(t, dbfile)
+	issued, err := store.Issue(&Token{Label: "laptop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tok := range tokens {
+		if tok.Hash == "user1" || tok.Hash == issued || !strings.HasPrefix(tok.Hash, hashPrefix) {
+			t.Fatalf("expected only hashes to be stored, got %q", tok.Hash)
+		}
+	}
+	for _, token := range []string{issued, "user1"} {
+		tok, err := store.Lookup(token)
+		if err != nil {
+			t.Fatalf("expected %q to be found by its hash, got %v", token, err)
+		}
+		if !tok.HasScope(scopeQuotesRead) {
+			t.Fatalf("expected %q to have the default scopes, got %q", token, tok.Scopes)
+		}
+	}
+	store.Close()
+
+	// with another pepper none of the hashes match
+	store, err = NewTokenStore("sqlite3", dbfile, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for _, token := range []string{issued, "user1"} {
+		if _, err := store.Lookup(token); err != errNoSuchToken {
+			t.Fatalf("expected %q not to be found with another pepper, got %v", token, err)
+		}
+	}
+}
+
+func TestTokenScopes(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	store := setupStore(t, filepath.Join(tempDir, "db"))
+	defer store.Close()
+
+	s := httptest.NewServer(NewAuthHandler(store, testConfig(testAdminToken)))
+	defer s.Close()
+
+	issued := make(map[string]interface{})
+	makeAdminRequest(t, "POST", s.URL+"/tokens", testAdminToken,
+		`{"Label": "editor", "Scopes": ["quotes:read", "quotes:write"]}`, http.StatusCreated, &issued)
+	editor := issued["Token"].(string)
+	makeAdminRequest(t, "POST", s.URL+"/tokens", testAdminToken,
+		`{"Label": "reader"}`, http.StatusCreated, &issued)
+	reader := issued["Token"].(string)
+	makeAdminRequest(t, "POST", s.URL+"/tokens", testAdminToken,
+		`{"Label": "admin", "Scopes": ["tokens:admin"]}`, http.StatusCreated, &issued)
+	admin := issued["Token"].(string)
+	makeAdminRequest(t, "POST", s.URL+"/tokens", testAdminToken,
+		`{"Label": "root", "Scopes": ["everything"]}`, http.StatusBadRequest, nil)
+
+	for token, expected := range map[string]string{
+		editor: "quotes:read quotes:write",
+		reader: "quotes:read",
+		admin:  "tokens:admin",
+	} {
+		verified := &verifyResponse{}
+		makeAdminRequest(t, "POST", s.URL+"/token/verify", token, "", http.StatusOK, verified)
+		if scopes := strings.Join(verified.Scopes, " "); scopes != expected {
+			t.Fatalf("expected scopes %q, got %q", expected, scopes)
+		}
+	}
+
+	// only the token with the tokens:admin scope can manage tokens
+	var listed []map[string]interface{}
+	makeAdminRequest(t, "GET", s.URL+"/tokens", admin, "", http.StatusOK, &listed)
+	if len(listed) != 3 {
+		t.Fatalf("expected 3 tokens, got %v", listed)
+	}
+	makeAdminRequest(t, "GET", s.URL+"/tokens", editor, "", http.StatusForbidden, nil)
+	makeAdminRequest(t, "GET", s.URL+"/tokens", reader, "", http.StatusForbidden, nil)
+
+	rotated := &issuedToken{}
+	rotateURL := fmt.Sprintf("%s/tokens/%v/rotate", s.URL, listed[0]["ID"])
+	makeAdminRequest(t, "POST", rotateURL, admin, "", http.StatusCreated, rotated)
+	if strings.Join(rotated.Scopes, " ") != "quotes:read quotes:write" {
+		t.Fatalf("expected the rotated token to keep its scopes, got %v", rotated.Scopes)
+	}
+}
+
+func TestSignedTokens(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	store := setupStore(t, filepath.Join(tempDir, "db"))
+	defer store.Close()
+	key, err := LoadSigningKey(filepath.Join(tempDir, "key"))
+	if err != nil {
+		t.Fatalf("expected no error creating a signing key: %s", err)
+	}
+	store.SetSigner(NewSigner(key, time.Hour))
+
+	s := httptest.NewServer(NewAuthHandler(store, testConfig(testAdminToken)))
+	defer s.Close()
+
+	keys := &jwkSet{}
+	makeAdminRequest(t, "GET", s.URL+"/.well-known/jwks.json", "", "", http.StatusOK, keys)
+	if len(keys.Keys) != 1 || keys.Keys[0].Crv != "Ed25519" {
+		t.Fatalf("expected one Ed25519 key, got %v", keys.Keys)
+	}
+	public, err := base64.RawURLEncoding.DecodeString(keys.Keys[0].X)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issued := &issuedToken{}
+	makeAdminRequest(t, "POST", s.URL+"/tokens", testAdminToken,
+		`{"Label": "gui", "Signed": true}`, http.StatusCreated, issued)
+	parts := strings.Split(issued.Token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("expected a JWT, got %q", issued.Token)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !ed25519.Verify(public, []byte(parts[0]+"."+parts[1]), sig) {
+		t.Fatal("expected the token to be signed with the published key")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := &jwtClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.ID != strconv.FormatInt(issued.ID, 10) || claims.Scope != scopeQuotesRead ||
+		claims.Subject != "gui" || claims.Expires != issued.Expires.Unix() {
+		t.Fatalf("unexpected claims %+v for %+v", claims, issued)
+	}
+	if left := claims.Expires - time.Now().Unix(); left <= 0 || left > 3600 {
+		t.Fatalf("expected the token to last the default hour, it has %d seconds left", left)
+	}
+
+	// the auth server still knows the token, for the online check
+	makeVerifyRequest(t, s.URL, issued.Token, "", http.StatusOK)
+
+	withdrawn := &withdrawnList{}
+	makeAdminRequest(t, "GET", s.URL+"/.well-known/revoked.json", "", "", http.StatusOK, withdrawn)
+	if len(withdrawn.Withdrawn) != 0 {
+		t.Fatalf("expected no withdrawn tokens yet, got %v", withdrawn.Withdrawn)
+	}
+
+	rotated := &issuedToken{}
+	makeAdminRequest(t, "POST", fmt.Sprintf("%s/tokens/%d/rotate", s.URL, issued.ID),
+		testAdminToken, `{"Grace": "5m"}`, http.StatusCreated, rotated)
+	if !rotated.Signed || strings.Count(rotated.Token, ".") != 2 {
+		t.Fatalf("expected the replacement to be signed too, got %+v", rotated)
+	}
+	makeAdminRequest(t, "DELETE", fmt.Sprintf("%s/tokens/%d", s.URL, rotated.ID),
+		testAdminToken, "", http.StatusNoContent, nil)
+
+	makeAdminRequest(t, "GET", s.URL+"/.well-known/revoked.json", "", "", http.StatusOK, withdrawn)
+	until := make(map[string]time.Time)
+	for _, w := range withdrawn.Withdrawn {
+		until[w.ID] = w.Until
+	}
+	if len(until) != 2 {
+		t.Fatalf("expected the rotated and the revoked token to be withdrawn, got %v", withdrawn.Withdrawn)
+	}
+	if end := until[claims.ID]; end.Before(time.Now()) || end.After(time.Now().Add(5*time.Minute)) {
+		t.Fatalf("expected the rotated token to be withdrawn after the grace period, got %s", end)
+	}
+	if end := until[strconv.FormatInt(rotated.ID, 10)]; end.After(time.Now()) {
+		t.Fatalf("expected the revoked token to be withdrawn already, got %s", end)
+	}
+}
+
+func TestSignedTokensNeedSigningKey(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	store := setupStore(t, filepath.Join(tempDir, "db"))
+	defer store.Close()
+
+	s := httptest.NewServer(NewAuthHandler(store, testConfig(testAdminToken)))
+	defer s.Close()
+
+	makeAdminRequest(t, "POST", s.URL+"/tokens", testAdminToken,
+		`{"Label": "gui", "Signed": true}`, http.StatusBadRequest, nil)
+	keys := &jwkSet{}
+	makeAdminRequest(t, "GET", s.URL+"/.well-known/jwks.json", "", "", http.StatusOK, keys)
+	if len(keys.Keys) != 0 {
+		t.Fatalf("expected no keys to be published, got %v", keys.Keys)
+	}
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, "key")
+
+	created, err := LoadSigningKey(path)
+	if err != nil {
+		t.Fatalf("expected no error creating a signing key: %s", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected the key to be written only readable by its owner, got %v, %v", info, err)
+	}
+	loaded, err := LoadSigningKey(path)
+	if err != nil || !bytes.Equal(created, loaded) {
+		t.Fatalf("expected the same key to be loaded again, got %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSigningKey(path); err == nil {
+		t.Fatal("expected an error loading a file that doesn't hold a key")
+	}
+}
+
+func TestCacheHintsAndPurge(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	store := setupStore(t, filepath.Join(tempDir, "db"))
+	defer store.Close()
+
+	purged := make(chan int64, 1)
+	quoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(purgeSecretHeader) != "sshh" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		req := &purgeRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err == nil {
+			purged <- req.ID
+		}
+	}))
+	defer quoteServer.Close()
+
+	config := testConfig(testAdminToken)
+	config.PurgeURLs = []string{quoteServer.URL}
+	config.PurgeSecret = "sshh"
+	s := httptest.NewServer(NewAuthHandler(store, config))
+	defer s.Close()
+
+	forever, err := store.Add("goody", seedLabel, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	soon, err := store.Issue(&Token{Label: "soon", Expires: time.Now().Add(10 * time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cc := makeRequest(t, s.URL, "goody", http.StatusOK).Get("Cache-Control"); cc != "private, max-age=30" {
+		t.Fatalf("expected a valid token to be cacheable for 30 seconds, got %q", cc)
+	}
+	if cc := makeRequest(t, s.URL, "baddy", http.StatusUnauthorized).Get("Cache-Control"); cc != "private, max-age=5" {
+		t.Fatalf("expected an invalid token to be cacheable for 5 seconds, got %q", cc)
+	}
+	cc := makeRequest(t, s.URL, soon, http.StatusOK).Get("Cache-Control")
+	if cc != "private, max-age=9" && cc != "private, max-age=10" {
+		t.Fatalf("expected a token expiring soon not to be cached past its expiry, got %q", cc)
+	}
+
+	makeAdminRequest(t, "DELETE", fmt.Sprintf("%s/tokens/%d", s.URL, forever.ID),
+		testAdminToken, "", http.StatusNoContent, nil)
+	select {
+	case id := <-purged:
+		if id != forever.ID {
+			t.Fatalf("expected token %d to be purged, got %d", forever.ID, id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the quote server to be told to purge the revoked token")
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	store := setupStore(t, filepath.Join(tempDir, "db"))
+
+	s := httptest.NewServer(NewAuthHandler(store, testConfig("")))
+	defer s.Close()
+
+	check := func(path string, expected int) *healthReport {
+		resp, err := http.Get(s.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Fatalf("expected a %v response from %s, got %v", expected, path, resp.StatusCode)
+		}
+		report := &healthReport{}
+		if err := json.NewDecoder(resp.Body).Decode(report); err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+
+	if report := check("/healthz", http.StatusOK); report.Status != statusOK {
+		t.Fatalf("expected the auth server to be alive, got %+v", report)
+	}
+	report := check("/readyz", http.StatusOK)
+	if dep := report.Dependencies["store"]; report.Status != statusOK || dep == nil || dep.Status != statusOK {
+		t.Fatalf("expected the auth server to be ready, got %+v", report)
+	}
+
+	store.Close()
+	report = check("/readyz", http.StatusServiceUnavailable)
+	if dep := report.Dependencies["store"]; report.Status != statusDown || dep.Status != statusDown || dep.Error == "" {
+		t.Fatalf("expected the store to be down, got %+v", report)
+	}
+	if report := check("/healthz", http.StatusOK); report.Status != statusOK {
+		t.Fatalf("expected the auth server to still be alive, got %+v", report)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Health statuses
+const (
+	statusOK   = "ok"
+	statusDown = "down"
+)
+
+// dependencyHealth is the state of something the auth server depends on,
+// and how long checking it took
+type dependencyHealth struct {
+	Status    string
+	LatencyMs float64
+	Error     string `json:",omitempty"`
+}
+
+// healthReport is the body of a health response
+type healthReport struct {
+	Status       string
+	Dependencies map[string]*dependencyHealth `json:",omitempty"`
+}
+
+// liveHandler reports the auth server is running
+func liveHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &healthReport{Status: statusOK})
+}
+
+// readyHandler returns a handler that reports whether tokens can be checked,
+// which needs the token store
+func readyHandler(store *TokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		err := store.Ping()
+		health := &dependencyHealth{
+			Status:    statusOK,
+			LatencyMs: float64(time.Since(start)) / float64(time.Millisecond),
+		}
+		report := &healthReport{Status: statusOK, Dependencies: map[string]*dependencyHealth{"store": health}}
+		status := http.StatusOK
+		if err != nil {
+			health.Status = statusDown
+			health.Error = err.Error()
+			report.Status = statusDown
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, report)
+	}
+}
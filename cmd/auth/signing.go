@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// defaultSignedTTL is how long signed tokens last if they aren't given an
+// expiry. The quote server only learns a signed token was revoked when it
+// next fetches the revocation list, so they are kept fairly short-lived.
+const defaultSignedTTL = 24 * time.Hour
+
+// signingAlg is the JWT algorithm name for Ed25519 signatures
+const signingAlg = "EdDSA"
+
+// Signer signs tokens as JWTs with an Ed25519 key
+type Signer struct {
+	key ed25519.PrivateKey
+	kid string
+	ttl time.Duration
+}
+
+// jwtHeader is the header of a signed token
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// jwtClaims are what a signed token says about itself. The ID is that of the
+// stored token, so it can be revoked, and the scopes are separated by spaces.
+type jwtClaims struct {
+	ID        string `json:"jti"`
+	Subject   string `json:"sub"`
+	Scope     string `json:"scope"`
+	IssuedAt  int64  `json:"iat"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	Expires   int64  `json:"exp"`
+}
+
+// jwk is a public key in the JSON Web Key format
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+}
+
+// jwkSet is the set of public keys signed tokens can be checked against
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// NewSigner returns a signer using the key, whose signed tokens last for ttl
+// unless they are given an expiry
+func NewSigner(key ed25519.PrivateKey, ttl time.Duration) *Signer {
+	sum := sha256.Sum256(key.Public().(ed25519.PublicKey))
+	return &Signer{
+		key: key,
+		kid: base64.RawURLEncoding.EncodeToString(sum[:8]),
+		ttl: ttl,
+	}
+}
+
+// LoadSigningKey reads a hex encoded Ed25519 seed from the file, generating
+// one and writing it there if the file doesn't exist yet
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		seed := hex.EncodeToString(key.Seed()) + "\n"
+		if err := ioutil.WriteFile(path, []byte(seed), 0600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s does not hold a hex encoded Ed25519 seed", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// Sign returns the token as a JWT signed with the signer's key
+func (s *Signer) Sign(tok *Token) (string, error) {
+	claims := &jwtClaims{
+		ID:       strconv.FormatInt(tok.ID, 10),
+		Subject:  tok.Label,
+		Scope:    tok.Scopes,
+		IssuedAt: tok.Created.Unix(),
+		Expires:  tok.Expires.Unix(),
+	}
+	if !tok.NotBefore.IsZero() {
+		claims.NotBefore = tok.NotBefore.Unix()
+	}
+	header, err := json.Marshal(&jwtHeader{Alg: signingAlg, Typ: "JWT", Kid: s.kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	sig := ed25519.Sign(s.key, []byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// KeySet returns the public key set to publish
+func (s *Signer) KeySet() *jwkSet {
+	return &jwkSet{Keys: []jwk{{
+		Kty: "OKP",
+		Crv: "Ed25519",
+		X:   base64.RawURLEncoding.EncodeToString(s.key.Public().(ed25519.PublicKey)),
+		Kid: s.kid,
+		Use: "sig",
+		Alg: signingAlg,
+	}}}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-xorm/xorm"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// tokenBytes is how many random bytes make up an issued token
+const tokenBytes = 32
+
+// hashPrefix marks a stored token as hashed, telling it apart from the
+// plaintext tokens older versions stored
+const hashPrefix = "hmac-sha256:"
+
+// Scopes a token can be granted
+const (
+	scopeQuotesRead  = "quotes:read"
+	scopeQuotesWrite = "quotes:write"
+	scopeTokensAdmin = "tokens:admin"
+)
+
+// knownScopes are the scopes that can be granted
+var knownScopes = []string{scopeQuotesRead, scopeQuotesWrite, scopeTokensAdmin}
+
+// defaultScopes are granted to tokens that aren't given any, including those
+// stored before there were scopes
+var defaultScopes = []string{scopeQuotesRead}
+
+var (
+	errNoSuchToken  = errors.New("no such token")
+	errTokenInvalid = errors.New("token is revoked, expired or not yet valid")
+	errNoSigner     = errors.New("signed tokens are not enabled")
+)
+
+// Token is an auth token that has been issued. Only a hash of the token is
+// kept. Scopes are separated by spaces. A zero NotBefore or Expires means the
+// token isn't limited that way. Signed tokens carry their own scopes and
+// expiry, signed by the auth server, so they can be checked without asking
+// it. Retired is when a rotated token stops being valid.
+type Token struct {
+	ID        int64     `xorm:"id"`
+	Hash      string    `xorm:"token unique notnull"`
+	Label     string    `xorm:"label"`
+	Scopes    string    `xorm:"scopes"`
+	Signed    bool      `xorm:"signed"`
+	Created   time.Time `xorm:"created"`
+	NotBefore time.Time `xorm:"not_before"`
+	Expires   time.Time `xorm:"expires"`
+	Retired   time.Time `xorm:"retired"`
+	Revoked   time.Time `xorm:"revoked"`
+}
+
+// ValidUntil returns when the token stops being valid, whether because it
+// expires, was rotated or was revoked, or the zero time if it never does
+func (t *Token) ValidUntil() time.Time {
+	var until time.Time
+	for _, end := range []time.Time{t.Expires, t.Retired, t.Revoked} {
+		if !end.IsZero() && (until.IsZero() || end.Before(until)) {
+			until = end
+		}
+	}
+	return until
+}
+
+// ValidAt returns true if the token can be used at the given time
+func (t *Token) ValidAt(now time.Time) bool {
+	until := t.ValidUntil()
+	switch {
+	case !t.Revoked.IsZero():
+		return false
+	case !t.NotBefore.IsZero() && now.Before(t.NotBefore):
+		return false
+	case !until.IsZero() && !now.Before(until):
+		return false
+	}
+	return true
+}
+
+// ScopeList returns the scopes granted to the token
+func (t *Token) ScopeList() []string {
+	return strings.Fields(t.Scopes)
+}
+
+// HasScope returns true if the token has been granted the scope
+func (t *Token) HasScope(scope string) bool {
+	for _, s := range t.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// validateScopes returns an error naming the first scope that isn't known
+func validateScopes(scopes []string) error {
+	for _, scope := range scopes {
+		known := false
+		for _, k := range knownScopes {
+			known = known || scope == k
+		}
+		if !known {
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	return nil
+}
+
+// joinScopes returns scopes as they are stored, using the default scopes if
+// there are none
+func joinScopes(scopes []string) string {
+	if len(scopes) == 0 {
+		scopes = defaultScopes
+	}
+	return strings.Join(scopes, " ")
+}
+
+// TokenStore keeps hashes of issued tokens in a database. Tokens are hashed
+// with HMAC-SHA256 keyed with a server-wide pepper, which stays out of the
+// database, so a copy of the database alone isn't enough to guess even short
+// tokens such as those given on the command line. The hash has to be the same
+// every time for the token to be looked up by it, so there is no per-token
+// salt; issued tokens are random enough not to need one.
+type TokenStore struct {
+	db     *xorm.Engine
+	pepper []byte
+	signer *Signer
+}
+
+// NewTokenStore opens the token database, creating or updating its table if
+// need be. Changing the pepper invalidates every stored token.
+func NewTokenStore(dbtype, dbsource, pepper string) (*TokenStore, error) {
+	engine, err := xorm.NewEngine(dbtype, dbsource)
+	if err != nil {
+		return nil, err
+	}
+	t := &TokenStore{db: engine, pepper: []byte(pepper)}
+	err = engine.Sync2(&Token{})
+	if err == nil {
+		err = t.hashPlaintextTokens()
+	}
+	if err == nil {
+		// tokens from before there were scopes
+		_, err = engine.Where("scopes IS NULL OR scopes = ''").Cols("scopes").
+			Update(&Token{Scopes: joinScopes(nil)})
+	}
+	if err != nil {
+		engine.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// hash returns what is stored for a token
+func (t *TokenStore) hash(token string) string {
+	mac := hmac.New(sha256.New, t.pepper)
+	mac.Write([]byte(token))
+	return hashPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// hashPlaintextTokens replaces any tokens stored before they were hashed
+// with their hashes
+func (t *TokenStore) hashPlaintextTokens() error {
+	var tokens []Token
+	if err := t.db.Where("token NOT LIKE ?", hashPrefix+"%").Find(&tokens); err != nil {
+		return err
+	}
+	for _, tok := range tokens {
+		tok.Hash = t.hash(tok.Hash)
+		if _, err := t.db.Id(tok.ID).Cols("token").Update(&tok); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetSigner enables signed tokens, signed with the given key
+func (t *TokenStore) SetSigner(signer *Signer) {
+	t.signer = signer
+}
+
+// Ping checks the token database can be reached
+func (t *TokenStore) Ping() error {
+	return t.db.Ping()
+}
+
+// Close closes the token database
+func (t *TokenStore) Close() error {
+	return t.db.Close()
+}
+
+// Issue stores a new token with the label, scopes, validity period and kind
+// given in tok, using the default scopes if there are none. The token itself
+// is returned, and can't be recovered later.
+func (t *TokenStore) Issue(tok *Token) (string, error) {
+	if tok.Scopes == "" {
+		tok.Scopes = joinScopes(nil)
+	}
+	// closing the session rolls back anything not committed
+	session := t.db.NewSession()
+	defer session.Close()
+	if err := session.Begin(); err != nil {
+		return "", err
+	}
+	secret, err := t.insert(session, tok)
+	if err != nil {
+		return "", err
+	}
+	return secret, session.Commit()
+}
+
+// insert stores a new token, filling in its ID and hash, and returns the
+// token itself
+func (t *TokenStore) insert(session *xorm.Session, tok *Token) (string, error) {
+	b := make([]byte, tokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(b)
+	if tok.Signed {
+		if t.signer == nil {
+			return "", errNoSigner
+		}
+		if tok.Expires.IsZero() {
+			tok.Expires = time.Now().Add(t.signer.ttl)
+		}
+	}
+
+	tok.Hash = t.hash(secret)
+	if _, err := session.Insert(tok); err != nil {
+		return "", err
+	}
+	if !tok.Signed {
+		return secret, nil
+	}
+
+	// a signed token carries its ID, which is only known now, so the random
+	// secret above was just a placeholder
+	secret, err := t.signer.Sign(tok)
+	if err != nil {
+		return "", err
+	}
+	tok.Hash = t.hash(secret)
+	if _, err := session.Id(tok.ID).Cols("token").Update(tok); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// Add stores a token chosen by the caller with the given scopes, or the
+// default ones if there are none, or returns the existing one if it has
+// already been stored
+func (t *TokenStore) Add(token, label string, scopes []string) (*Token, error) {
+	existing, err := t.Lookup(token)
+	if err != errNoSuchToken {
+		return existing, err
+	}
+	tok := &Token{Hash: t.hash(token), Label: label, Scopes: joinScopes(scopes)}
+	if _, err := t.db.Insert(tok); err != nil {
+		return nil, err
+	}
+	return tok, nil
+}
+
+// List returns every token, revoked or not, oldest first
+func (t *TokenStore) List() ([]Token, error) {
+	tokens := []Token{}
+	err := t.db.Asc("id").Find(&tokens)
+	return tokens, err
+}
+
+// Revoke stops a token from being accepted
+func (t *TokenStore) Revoke(id int64) error {
+	tok := &Token{}
+	has, err := t.db.Id(id).Get(tok)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return errNoSuchToken
+	}
+	if !tok.Revoked.IsZero() {
+		return nil
+	}
+	tok.Revoked = time.Now()
+	_, err = t.db.Id(id).Cols("revoked").Update(tok)
+	return err
+}
+
+// Rotate issues a replacement for a token, of the same kind and with the
+// same label, scopes and lifetime, and retires the old token so that it
+// stops being valid after the grace period
+func (t *TokenStore) Rotate(id int64, grace time.Duration) (*Token, string, error) {
+	// closing the session rolls back anything not committed
+	session := t.db.NewSession()
+	defer session.Close()
+	if err := session.Begin(); err != nil {
+		return nil, "", err
+	}
+
+	old := &Token{}
+	has, err := session.Id(id).Get(old)
+	if err != nil {
+		return nil, "", err
+	}
+	if !has {
+		return nil, "", errNoSuchToken
+	}
+	now := time.Now()
+	if !old.ValidAt(now) {
+		return nil, "", errTokenInvalid
+	}
+
+	tok := &Token{Label: old.Label, Scopes: old.Scopes, Signed: old.Signed}
+	if !old.Expires.IsZero() {
+		tok.Expires = now.Add(old.Expires.Sub(old.Created))
+	}
+	secret, err := t.insert(session, tok)
+	if err != nil {
+		return nil, "", err
+	}
+	if end, until := now.Add(grace), old.ValidUntil(); until.IsZero() || end.Before(until) {
+		old.Retired = end
+		if _, err := session.Id(id).Cols("retired").Update(old); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := session.Commit(); err != nil {
+		return nil, "", err
+	}
+	return tok, secret, nil
+}
+
+// Withdrawn returns the signed tokens that have been revoked or retired but
+// haven't expired yet, which means they would still pass a signature check
+func (t *TokenStore) Withdrawn() ([]Token, error) {
+	var signed []Token
+	if err := t.db.Where("signed = ?", true).Asc("id").Find(&signed); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	withdrawn := []Token{}
+	for _, tok := range signed {
+		if (!tok.Revoked.IsZero() || !tok.Retired.IsZero()) && now.Before(tok.Expires) {
+			withdrawn = append(withdrawn, tok)
+		}
+	}
+	return withdrawn, nil
+}
+
+// Lookup returns the stored token, whether or not it is still valid
+func (t *TokenStore) Lookup(token string) (*Token, error) {
+	hash := t.hash(token)
+	tok := &Token{}
+	has, err := t.db.Where("token = ?", hash).Get(tok)
+	if err != nil {
+		return nil, err
+	}
+	// the database found the row by comparing hashes, but don't rely on how
+	// it does that
+	if !has || subtle.ConstantTimeCompare([]byte(tok.Hash), []byte(hash)) != 1 {
+		return nil, errNoSuchToken
+	}
+	return tok, nil
+}
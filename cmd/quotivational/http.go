@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 )
@@ -12,12 +11,25 @@ const (
 	authHeader = "X-Auth-Token"
 	randomPath = "/randomquote"
 	topicPath  = "/quotes/%s"
+	topicsPath = "/topics"
 )
 
+// StatusError is returned when the quote server answers with an error
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+// Error returns the status the server answered with
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected response from the quote server: %s", e.Status)
+}
+
 // HTTPQuoter gets a quote from a quote server
 type HTTPQuoter struct {
-	url   url.URL
-	token string
+	url    url.URL
+	token  string
+	client *http.Client
 }
 
 // NewHTTPQuoter returns a HTTPQuoter instance
@@ -27,38 +39,74 @@ func NewHTTPQuoter(baseURL string, authToken string) (*HTTPQuoter, error) {
 		return nil, err
 	}
 	return &HTTPQuoter{
-		url:   *u,
-		token: authToken,
+		url:    *u,
+		token:  authToken,
+		client: http.DefaultClient,
 	}, nil
 }
 
 // Quote gets a quote of a particular topic
-func (h HTTPQuoter) Quote(topic string) (*Quote, error) {
-	u, err := h.url.Parse(
-		fmt.Sprintf(topicPath, topic),
-	)
+func (h *HTTPQuoter) Quote(ctx Context, topic string) (*Quote, error) {
+	return h.getQuote(ctx, fmt.Sprintf(topicPath, topic))
+}
+
+// RandomQuote gets a quote of any topic, which the server picks from those
+// the token hasn't been shown lately
+func (h *HTTPQuoter) RandomQuote(ctx Context) (*Quote, error) {
+	return h.getQuote(ctx, randomPath)
+}
+
+func (h *HTTPQuoter) getQuote(ctx Context, path string) (*Quote, error) {
+	q := &Quote{}
+	err := h.get(ctx, path, q)
+	if e, ok := err.(*StatusError); ok && e.StatusCode == http.StatusNotFound {
+		return nil, ErrNoQuotes
+	}
 	if err != nil {
 		return nil, err
 	}
+	return q, nil
+}
+
+// Topics gets the topics the server has quotes in
+func (h *HTTPQuoter) Topics(ctx Context) ([]TopicCount, error) {
+	var topics []TopicCount
+	if err := h.get(ctx, topicsPath, &topics); err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
+// get decodes the JSON the server answers a GET of path with into v,
+// returning a StatusError if the answer isn't a 200
+func (h *HTTPQuoter) get(ctx Context, path string, v interface{}) error {
+	u, err := h.url.Parse(path)
+	if err != nil {
+		return err
+	}
 	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	req.Header[authHeader] = []string{h.token}
+	req.Cancel = ctx.Done()
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := h.client.Do(req)
 	if err != nil {
-		return nil, err
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return err
 	}
 	defer resp.Body.Close()
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
 	}
-	q := &Quote{}
-	err = json.Unmarshal(b, q)
-	if err != nil {
-		return nil, err
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return fmt.Errorf("couldn't read the quote server's answer: %s", err)
 	}
-	return q, nil
+	return nil
 }
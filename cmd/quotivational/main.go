@@ -2,18 +2,27 @@ package main
 
 import (
 	"log"
+	"os"
 
 	"github.com/gotk3/gotk3/gtk"
 )
 
 func main() {
+	settings, err := loadSettings(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if settings == nil {
+		return
+	}
+
 	gtk.Init(nil)
 
 	w, err := setupWindow("Quotivational", 400, 175)
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = setupWidgets(w)
+	err = setupWidgets(w, settings)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryQuoter returns quotes it holds, going through each topic's in turn.
+// It stands in for a quote server in tests, and lets the client work from a
+// file of quotes without one.
+type MemoryQuoter struct {
+	sync.Mutex
+	topics []string
+	quotes map[string][]Quote
+	next   map[string]int
+	// nextAny is the index of the next quote RandomQuote returns, counting
+	// through the topics in order
+	nextAny int
+}
+
+// NewMemoryQuoter returns a MemoryQuoter holding the quotes, by topic
+func NewMemoryQuoter(quotes map[string][]Quote) *MemoryQuoter {
+	m := &MemoryQuoter{
+		quotes: make(map[string][]Quote),
+		next:   make(map[string]int),
+	}
+	for topic, q := range quotes {
+		if len(q) == 0 {
+			continue
+		}
+		m.topics = append(m.topics, topic)
+		m.quotes[topic] = append([]Quote{}, q...)
+	}
+	sort.Strings(m.topics)
+	return m
+}
+
+// fileQuote is a line of a quotes file, as the quote server exports them
+type fileQuote struct {
+	Topic  string
+	Text   string
+	Author string
+}
+
+// NewFileQuoter returns a MemoryQuoter holding the quotes in a file with a
+// JSON object on each line giving the Topic, Text and Author of a quote, as
+// the quote server's export command writes
+func NewFileQuoter(path string) (*MemoryQuoter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	quotes := make(map[string][]Quote)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		q := &fileQuote{}
+		if err := json.Unmarshal([]byte(text), q); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		topic := strings.ToLower(q.Topic)
+		quotes[topic] = append(quotes[topic], Quote{Quote: q.Text, Author: q.Author})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewMemoryQuoter(quotes), nil
+}
+
+// Quote returns the next quote of the topic
+func (m *MemoryQuoter) Quote(ctx Context, topic string) (*Quote, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.Lock()
+	defer m.Unlock()
+	quotes := m.quotes[topic]
+	if len(quotes) == 0 {
+		return nil, ErrNoQuotes
+	}
+	q := quotes[m.next[topic]%len(quotes)]
+	m.next[topic]++
+	return &q, nil
+}
+
+// RandomQuote returns the next quote of any topic, going through every quote
+// before returning one again
+func (m *MemoryQuoter) RandomQuote(ctx Context) (*Quote, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.Lock()
+	defer m.Unlock()
+	total := 0
+	for _, topic := range m.topics {
+		total += len(m.quotes[topic])
+	}
+	if total == 0 {
+		return nil, ErrNoQuotes
+	}
+	i := m.nextAny % total
+	m.nextAny++
+	for _, topic := range m.topics {
+		if i < len(m.quotes[topic]) {
+			q := m.quotes[topic][i]
+			return &q, nil
+		}
+		i -= len(m.quotes[topic])
+	}
+	return nil, ErrNoQuotes
+}
+
+// Topics returns the topics there are quotes in, in order
+func (m *MemoryQuoter) Topics(ctx Context) ([]TopicCount, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.Lock()
+	defer m.Unlock()
+	counts := make([]TopicCount, 0, len(m.topics))
+	for _, topic := range m.topics {
+		counts = append(counts, TopicCount{Topic: topic, Count: len(m.quotes[topic])})
+	}
+	return counts, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gotk3/gotk3/gtk"
+)
+
+// maxRefreshSeconds is the longest refresh interval the preferences offer
+const maxRefreshSeconds = 24 * 60 * 60
+
+// preferenceField is a field of the preferences, which is greyed out when
+// its setting can't be changed
+type preferenceField interface {
+	gtk.IWidget
+	SetSensitive(bool)
+}
+
+// preferencesDialog lets the user change the settings
+type preferencesDialog struct {
+	current *Settings
+	dialog  *gtk.Dialog
+	server  *gtk.Entry
+	token   *gtk.Entry
+	topic   *gtk.ComboBoxText
+	refresh *gtk.SpinButton
+}
+
+func newPreferencesDialog(parent *gtk.Window, s *Settings, topics []string) (*preferencesDialog, error) {
+	d, err := gtk.DialogNew()
+	if err != nil {
+		return nil, err
+	}
+	d.SetTitle("Preferences")
+	d.SetTransientFor(parent)
+	d.SetModal(true)
+	if _, err := d.AddButton("Cancel", gtk.RESPONSE_CANCEL); err != nil {
+		return nil, err
+	}
+	if _, err := d.AddButton("Save", gtk.RESPONSE_ACCEPT); err != nil {
+		return nil, err
+	}
+	d.SetDefaultResponse(gtk.RESPONSE_ACCEPT)
+
+	p := &preferencesDialog{current: s, dialog: d}
+	if p.server, err = gtk.EntryNew(); err != nil {
+		return nil, err
+	}
+	p.server.SetText(s.ServerURL)
+	p.server.SetActivatesDefault(true)
+
+	if p.token, err = gtk.EntryNew(); err != nil {
+		return nil, err
+	}
+	p.token.SetText(s.Token)
+	p.token.SetVisibility(false)
+	p.token.SetActivatesDefault(true)
+
+	// topics can be typed in as well as picked, since the server may have
+	// more than it said, and left empty for any topic
+	if p.topic, err = gtk.ComboBoxTextNewWithEntry(); err != nil {
+		return nil, err
+	}
+	active := -1
+	for i, t := range topics {
+		p.topic.AppendText(t)
+		if t == s.Topic {
+			active = i
+		}
+	}
+	if active < 0 && s.Topic != "" {
+		p.topic.PrependText(s.Topic)
+		active = 0
+	}
+	p.topic.SetActive(active)
+
+	if p.refresh, err = gtk.SpinButtonNewWithRange(0, maxRefreshSeconds, 1); err != nil {
+		return nil, err
+	}
+	p.refresh.SetValue(s.RefreshInterval.Seconds())
+
+	grid, err := gtk.GridNew()
+	if err != nil {
+		return nil, err
+	}
+	grid.SetRowSpacing(6)
+	grid.SetColumnSpacing(12)
+	grid.SetBorderWidth(12)
+	rows := []struct {
+		label string
+		name  string
+		field preferenceField
+	}{
+		{"Server URL", "server", p.server},
+		{"Token", "token", p.token},
+		{"Default topic", "topic", p.topic},
+		{"New quote every (seconds, 0 for never)", "refresh-interval", p.refresh},
+	}
+	for i, row := range rows {
+		label, err := gtk.LabelNew(row.label)
+		if err != nil {
+			return nil, err
+		}
+		label.SetHAlign(gtk.ALIGN_START)
+		grid.Attach(label, 0, i, 1, 1)
+		grid.Attach(row.field, 1, i, 1, 1)
+
+		source, ok := s.overridden[row.name]
+		if !ok {
+			continue
+		}
+		row.field.SetSensitive(false)
+		note, err := gtk.LabelNew(overrideNote(source))
+		if err != nil {
+			return nil, err
+		}
+		note.SetHAlign(gtk.ALIGN_START)
+		grid.Attach(note, 2, i, 1, 1)
+	}
+	content, err := d.GetContentArea()
+	if err != nil {
+		return nil, err
+	}
+	content.Add(grid)
+	return p, nil
+}
+
+// settings returns the settings the dialog has been filled in with
+func (p *preferencesDialog) settings() (*Settings, error) {
+	server, err := p.server.GetText()
+	if err != nil {
+		return nil, err
+	}
+	token, err := p.token.GetText()
+	if err != nil {
+		return nil, err
+	}
+	return &Settings{
+		ServerURL:       server,
+		Token:           token,
+		Topic:           p.topic.GetActiveText(),
+		RefreshInterval: time.Duration(p.refresh.GetValueAsInt()) * time.Second,
+		QuotesFile:      p.current.QuotesFile,
+		file:            p.current.file,
+		overridden:      p.current.overridden,
+	}, nil
+}
+
+// overrideNote tells the user why a setting can't be changed
+func overrideNote(source string) string {
+	if !strings.HasPrefix(source, "$") {
+		source = "the " + source
+	}
+	return fmt.Sprintf("Set by %s", source)
+}
+
+// showError shows an error over the dialog
+func (p *preferencesDialog) showError(err error) {
+	m := gtk.MessageDialogNew(p.dialog, gtk.DIALOG_MODAL, gtk.MESSAGE_ERROR, gtk.BUTTONS_OK,
+		"%s", err.Error())
+	m.Run()
+	m.Destroy()
+}
+
+// runPreferences shows the preferences until they are saved or cancelled.
+// Settings are only saved once they have been checked against the quote
+// server, and when they are, they are returned.
+func runPreferences(parent *gtk.Window, s *Settings, topics []string) (*Settings, error) {
+	p, err := newPreferencesDialog(parent, s, topics)
+	if err != nil {
+		return nil, err
+	}
+	defer p.dialog.Destroy()
+	p.dialog.ShowAll()
+
+	for {
+		if gtk.ResponseType(p.dialog.Run()) != gtk.RESPONSE_ACCEPT {
+			return nil, nil
+		}
+		updated, err := p.settings()
+		if err != nil {
+			return nil, err
+		}
+		err = updated.check()
+		if err == nil {
+			err = updated.save(s)
+		}
+		if err != nil {
+			p.showError(err)
+			continue
+		}
+		return updated, nil
+	}
+}
@@ -1,12 +1,43 @@
 package main
 
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
 var (
+	// allTopics is used when the server can't be asked for its topics
 	allTopics = []string{"life", "computers", "science", "drinking"}
+
+	// ErrNoQuotes is returned when there are no quotes on a topic
+	ErrNoQuotes = errors.New("no quotes on that topic")
+
+	// ErrTimedOut is returned when a Context times out
+	ErrTimedOut = errors.New("timed out")
 )
 
-// Quoter is an interface for an object which returns a quote
+// Context carries a deadline for getting a quote, or a way to give up on it
+// sooner. It is the part of context.Context that quoters use, so that any
+// context.Context can be passed, but the client still builds with Go 1.6.
+type Context interface {
+	// Done is closed when the quote is no longer wanted
+	Done() <-chan struct{}
+
+	// Err returns why Done was closed, or nil if it hasn't been
+	Err() error
+}
+
+// Quoter is an interface for an object which returns quotes
 type Quoter interface {
-	Quote(topic string) (Quote, error)
+	// Quote gets a quote of a particular topic
+	Quote(ctx Context, topic string) (*Quote, error)
+
+	// RandomQuote gets a quote of any topic
+	RandomQuote(ctx Context) (*Quote, error)
+
+	// Topics gets the topics there are quotes in
+	Topics(ctx Context) ([]TopicCount, error)
 }
 
 // Quote is a structure representing a quote and its author
@@ -14,3 +45,49 @@ type Quote struct {
 	Quote  string `json:"Text"`
 	Author string `json:"Author"`
 }
+
+// TopicCount is a topic and how many quotes there are in it
+type TopicCount struct {
+	Topic string `json:"Topic"`
+	Count int    `json:"Count"`
+}
+
+// timeoutContext is a Context that is done once its timeout has passed or it
+// is cancelled
+type timeoutContext struct {
+	sync.Mutex
+	done  chan struct{}
+	timer *time.Timer
+	err   error
+}
+
+// withTimeout returns a Context that times out after timeout, and a function
+// that cancels it, which should be called once it's no longer needed
+func withTimeout(timeout time.Duration) (Context, func()) {
+	c := &timeoutContext{done: make(chan struct{})}
+	// held so that a short timeout can't finish before there's a timer
+	c.Lock()
+	c.timer = time.AfterFunc(timeout, func() { c.finish(ErrTimedOut) })
+	c.Unlock()
+	return c, func() { c.finish(errors.New("cancelled")) }
+}
+
+func (c *timeoutContext) finish(err error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.err == nil {
+		c.err = err
+		c.timer.Stop()
+		close(c.done)
+	}
+}
+
+func (c *timeoutContext) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *timeoutContext) Err() error {
+	c.Lock()
+	defer c.Unlock()
+	return c.err
+}
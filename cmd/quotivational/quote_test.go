@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// both quoters must do for the GUI
+var (
+	_ Quoter = &HTTPQuoter{}
+	_ Quoter = &MemoryQuoter{}
+)
+
+// testContext returns a context that's long enough for a test request
+func testContext() (Context, func()) {
+	return withTimeout(5 * time.Second)
+}
+
+// quoteServer answers requests for path, with the token, with the status and
+// body given
+func quoteServer(t *testing.T, path string, status int, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			t.Errorf("expected a request for %s, got %s", path, r.URL.Path)
+		}
+		if r.Header.Get(authHeader) != "token" {
+			t.Errorf("expected the token to be sent, got %q", r.Header.Get(authHeader))
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+}
+
+func TestHTTPQuoterQuotes(t *testing.T) {
+	quoteJSON := `{"ID": 1, "Topic": "life", "Text": "Be yourself", "Author": "Oscar Wilde"}`
+	expected := &Quote{Quote: "Be yourself", Author: "Oscar Wilde"}
+	for path, get := range map[string]func(Quoter, Context) (*Quote, error){
+		"/quotes/life": func(q Quoter, ctx Context) (*Quote, error) { return q.Quote(ctx, "life") },
+		randomPath:     func(q Quoter, ctx Context) (*Quote, error) { return q.RandomQuote(ctx) },
+	} {
+		server := quoteServer(t, path, http.StatusOK, quoteJSON)
+		q, err := NewHTTPQuoter(server.URL, "token")
+		if err != nil {
+			t.Fatalf("expected no error creating a quoter, got %s", err)
+		}
+		ctx, cancel := testContext()
+		quote, err := get(q, ctx)
+		cancel()
+		server.Close()
+		if err != nil {
+			t.Fatalf("expected a quote from %s, got %s", path, err)
+		}
+		if !reflect.DeepEqual(quote, expected) {
+			t.Fatalf("expected %v from %s, got %v", expected, path, quote)
+		}
+	}
+}
+
+func TestHTTPQuoterTopics(t *testing.T) {
+	server := quoteServer(t, topicsPath, http.StatusOK,
+		`[{"Topic": "life", "Count": 2}, {"Topic": "science", "Count": 1}]`)
+	defer server.Close()
+	q, err := NewHTTPQuoter(server.URL, "token")
+	if err != nil {
+		t.Fatalf("expected no error creating a quoter, got %s", err)
+	}
+	ctx, cancel := testContext()
+	defer cancel()
+	topics, err := q.Topics(ctx)
+	if err != nil {
+		t.Fatalf("expected topics, got %s", err)
+	}
+	expected := []TopicCount{{"life", 2}, {"science", 1}}
+	if !reflect.DeepEqual(topics, expected) {
+		t.Fatalf("expected %v, got %v", expected, topics)
+	}
+}
+
+func TestHTTPQuoterErrors(t *testing.T) {
+	for _, c := range []struct {
+		status int
+		body   string
+		check  func(error) bool
+	}{
+		{http.StatusUnauthorized, "", func(err error) bool {
+			e, ok := err.(*StatusError)
+			return ok && e.StatusCode == http.StatusUnauthorized
+		}},
+		{http.StatusNotFound, "", func(err error) bool { return err == ErrNoQuotes }},
+		{http.StatusInternalServerError, "", func(err error) bool {
+			e, ok := err.(*StatusError)
+			return ok && e.StatusCode == http.StatusInternalServerError
+		}},
+		{http.StatusOK, `{"Text": "cut off`, func(err error) bool {
+			_, ok := err.(*StatusError)
+			return err != nil && !ok && strings.Contains(err.Error(), "couldn't read")
+		}},
+	} {
+		server := quoteServer(t, "/quotes/life", c.status, c.body)
+		q, err := NewHTTPQuoter(server.URL, "token")
+		if err != nil {
+			t.Fatalf("expected no error creating a quoter, got %s", err)
+		}
+		ctx, cancel := testContext()
+		quote, err := q.Quote(ctx, "life")
+		cancel()
+		server.Close()
+		if quote != nil || !c.check(err) {
+			t.Fatalf("unexpected result for a %d answering %q: %v, %v", c.status, c.body, quote, err)
+		}
+	}
+
+	// topics not being found isn't the same as there being no quotes
+	server := quoteServer(t, topicsPath, http.StatusNotFound, "")
+	defer server.Close()
+	q, err := NewHTTPQuoter(server.URL, "token")
+	if err != nil {
+		t.Fatalf("expected no error creating a quoter, got %s", err)
+	}
+	ctx, cancel := testContext()
+	defer cancel()
+	if _, err := q.Topics(ctx); err == ErrNoQuotes {
+		t.Fatalf("expected a status error fetching topics, got %v", err)
+	}
+}
+
+func TestHTTPQuoterTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	q, err := NewHTTPQuoter(server.URL, "token")
+	if err != nil {
+		t.Fatalf("expected no error creating a quoter, got %s", err)
+	}
+	ctx, cancel := withTimeout(50 * time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := q.Quote(ctx, "life"); err != ErrTimedOut {
+		t.Fatalf("expected the request to time out, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("expected the request to be given up on when it timed out")
+	}
+}
+
+func TestMemoryQuoter(t *testing.T) {
+	life := []Quote{{"Be yourself", "Oscar Wilde"}, {"Live long", "Spock"}}
+	science := []Quote{{"Eppur si muove", "Galileo"}}
+	m := NewMemoryQuoter(map[string][]Quote{"science": science, "life": life, "empty": nil})
+	ctx, cancel := testContext()
+	defer cancel()
+
+	for _, expected := range []Quote{life[0], life[1], life[0]} {
+		quote, err := m.Quote(ctx, "life")
+		if err != nil || *quote != expected {
+			t.Fatalf("expected %v, got %v, %v", expected, quote, err)
+		}
+	}
+	if _, err := m.Quote(ctx, "empty"); err != ErrNoQuotes {
+		t.Fatalf("expected no quotes on a topic without any, got %v", err)
+	}
+	for _, expected := range []Quote{life[0], life[1], science[0], life[0]} {
+		quote, err := m.RandomQuote(ctx)
+		if err != nil || *quote != expected {
+			t.Fatalf("expected %v from any topic, got %v, %v", expected, quote, err)
+		}
+	}
+	topics, err := m.Topics(ctx)
+	expected := []TopicCount{{"life", 2}, {"science", 1}}
+	if err != nil || !reflect.DeepEqual(topics, expected) {
+		t.Fatalf("expected topics %v, got %v, %v", expected, topics, err)
+	}
+
+	cancel()
+	if _, err := m.Quote(ctx, "life"); err == nil {
+		t.Fatalf("expected an error once the context was cancelled")
+	}
+}
+
+func TestFileQuoter(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	path := filepath.Join(tempDir, "quotes.jsonl")
+	contents := `{"ID": 1, "Topic": "Life", "Text": "Be yourself", "Author": "Oscar Wilde"}
+
+{"ID": 2, "Topic": "science", "Text": "Eppur si muove", "Author": "Galileo"}
+`
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewFileQuoter(path)
+	if err != nil {
+		t.Fatalf("expected no error reading quotes, got %s", err)
+	}
+	ctx, cancel := testContext()
+	defer cancel()
+	quote, err := m.Quote(ctx, "life")
+	if err != nil || *quote != (Quote{"Be yourself", "Oscar Wilde"}) {
+		t.Fatalf("expected the quote from the file, got %v, %v", quote, err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(contents+"not json\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileQuoter(path); err == nil || !strings.Contains(err.Error(), ":4:") {
+		t.Fatalf("expected an error giving the bad line, got %v", err)
+	}
+}
+
+func TestSettingsSavedToTheFileLoaded(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	path := filepath.Join(tempDir, "elsewhere")
+	if err := ioutil.WriteFile(path, []byte("server = \"http://quotes:8080\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := loadSettings([]string{"-config", path, "-token", "secret"})
+	if err != nil {
+		t.Fatalf("expected no error loading settings, got %s", err)
+	}
+	if s.ServerURL != "http://quotes:8080" {
+		t.Fatalf("expected the server from the config file, got %q", s.ServerURL)
+	}
+	if source := s.overridden["token"]; source != "command line" {
+		t.Fatalf("expected the token to be overridden by the command line, got %q", source)
+	}
+	if _, ok := s.overridden["server"]; ok {
+		t.Fatalf("expected the server from the config file not to be overridden")
+	}
+
+	updated := *s
+	updated.Topic = "life"
+	if err := updated.save(s); err != nil {
+		t.Fatalf("expected no error saving settings, got %s", err)
+	}
+	saved, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the topic was changed, and the token only came from the command line
+	expected := "server = \"http://quotes:8080\"\ntopic = \"life\"\n"
+	if string(saved) != expected {
+		t.Fatalf("expected only the topic to be saved to %s, got:\n%s", path, saved)
+	}
+}
+
+func TestSettingsWithAQuotesFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	quotes := filepath.Join(tempDir, "quotes.jsonl")
+	if err := ioutil.WriteFile(quotes, []byte(`{"Topic": "life", "Text": "Be yourself", "Author": "Oscar Wilde"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := &Settings{QuotesFile: quotes}
+	if err := s.check(); err != nil {
+		t.Fatalf("expected a quotes file to do without a server or token, got %s", err)
+	}
+	s.QuotesFile = filepath.Join(tempDir, "missing")
+	if err := s.check(); err == nil {
+		t.Fatalf("expected a missing quotes file not to check out")
+	}
+}
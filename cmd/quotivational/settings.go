@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/endophage/quotivational/config"
+)
+
+const (
+	defaultServerURL = "http://localhost:8080"
+	defaultTopic     = "science"
+
+	// configFile is the name of the config file in configDir
+	configFile = "config"
+)
+
+// Settings is where the client gets its quotes from, and which
+type Settings struct {
+	ServerURL string
+	Token     string
+	Topic     string
+
+	// RefreshInterval is how often a new quote is shown without the button
+	// being clicked. Zero turns it off.
+	RefreshInterval time.Duration
+
+	// QuotesFile is a file of quotes to show instead of asking the server
+	QuotesFile string
+
+	// file is the config file the settings were read from, and are saved to
+	file string
+
+	// overridden says where the settings that were set on the command line
+	// or in the environment came from, by name. They can't be changed in the
+	// preferences, since saving them to the config file wouldn't change them.
+	overridden map[string]string
+}
+
+// configDir returns the directory the client keeps its config file in,
+// following the XDG base directory spec
+func configDir() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	return filepath.Join(dir, "quotivational")
+}
+
+// loadSettings reads the settings from the command line, the environment and
+// the config file. It returns nil settings if -print-config was given, after
+// printing them. A missing token isn't an error, since it can be set in the
+// preferences, and the server isn't needed with a quotes file.
+func loadSettings(args []string) (*Settings, error) {
+	flags := flag.NewFlagSet("quotivational", flag.ExitOnError)
+	s := &Settings{}
+	flags.StringVar(&s.ServerURL, "server", defaultServerURL, "The quote server's URL")
+	flags.StringVar(&s.Token, "token", "", "The token to get quotes with")
+	flags.StringVar(&s.Topic, "topic", defaultTopic, "The topic to show quotes from, or empty for any topic")
+	flags.DurationVar(&s.RefreshInterval, "refresh-interval", 0,
+		"How often to show a new quote without being asked, 0 to only when asked")
+	flags.StringVar(&s.QuotesFile, "quotes-file", "",
+		"A file of quotes to show instead of asking the server, as the server exports them")
+
+	defaultFile := filepath.Join(configDir(), configFile)
+	c, err := config.Load(flags, args, config.Options{
+		EnvPrefix:   "QUOTIVATIONAL",
+		DefaultFile: defaultFile,
+		Secret:      []string{"token"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if c.PrintRequested() {
+		c.Print(os.Stdout)
+		return nil, nil
+	}
+	if s.QuotesFile == "" {
+		if err := c.Require("server"); err != nil {
+			return nil, err
+		}
+	}
+
+	s.file = c.File()
+	if s.file == "" {
+		s.file = defaultFile
+	}
+	s.overridden = make(map[string]string)
+	flags.VisitAll(func(f *flag.Flag) {
+		if c.Overridden(f.Name) {
+			s.overridden[f.Name] = c.Source(f.Name)
+		}
+	})
+	return s, nil
+}
+
+// quoter returns the quoter the settings say to get quotes from
+func (s *Settings) quoter() (Quoter, error) {
+	if s.QuotesFile != "" {
+		q, err := NewFileQuoter(s.QuotesFile)
+		if err != nil {
+			return nil, err
+		}
+		return q, nil
+	}
+	return NewHTTPQuoter(s.ServerURL, s.Token)
+}
+
+// check makes sure the settings work by asking the quote server for its
+// topics with them, or by reading the quotes file if there is one
+func (s *Settings) check() error {
+	if s.RefreshInterval < 0 {
+		return errors.New("the refresh interval can't be negative")
+	}
+	if s.QuotesFile != "" {
+		_, err := NewFileQuoter(s.QuotesFile)
+		return err
+	}
+	u, err := url.Parse(s.ServerURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an http or https URL", s.ServerURL)
+	}
+	if s.Token == "" {
+		return errors.New("a token is needed to get quotes")
+	}
+	q, err := NewHTTPQuoter(s.ServerURL, s.Token)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(requestTimeout)
+	defer cancel()
+	if _, err := q.Topics(ctx); err != nil {
+		return fmt.Errorf("couldn't get quotes from %s with the token: %s", s.ServerURL, err)
+	}
+	return nil
+}
+
+// save writes the settings that have changed since the previous ones to the
+// config file they were read from, or the one in configDir if there wasn't
+// one. The rest of the file is left as it was, so values that only came from
+// the command line or the environment aren't written to it. Only the user can
+// read it, since it may hold the token.
+func (s *Settings) save(previous *Settings) error {
+	file := s.file
+	if file == "" {
+		file = filepath.Join(configDir(), configFile)
+	}
+	var changed []config.Setting
+	for _, setting := range []struct {
+		name          string
+		value, before string
+	}{
+		{"server", s.ServerURL, previous.ServerURL},
+		{"token", s.Token, previous.Token},
+		{"topic", s.Topic, previous.Topic},
+		{"refresh-interval", s.RefreshInterval.String(), previous.RefreshInterval.String()},
+		{"quotes-file", s.QuotesFile, previous.QuotesFile},
+	} {
+		if _, ok := s.overridden[setting.name]; !ok && setting.value != setting.before {
+			changed = append(changed, config.Setting{Name: setting.name, Value: setting.value})
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	return config.UpdateFile(file, changed)
+}
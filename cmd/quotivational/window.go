@@ -1,10 +1,19 @@
 package main
 
 import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gotk3/gotk3/glib"
 	"github.com/gotk3/gotk3/gtk"
 	"github.com/gotk3/gotk3/pango"
 )
 
+// requestTimeout is how long the quote server is given to answer
+const requestTimeout = 10 * time.Second
+
+// topic is the topic quotes are shown from, or any topic if it's empty
 var topic = "science"
 
 func setupWindow(title string, width, height int) (*gtk.Window, error) {
@@ -20,22 +29,55 @@ func setupWindow(title string, width, height int) (*gtk.Window, error) {
 	return w, nil
 }
 
-func setupMenuBar(g *gtk.Grid) error {
-	bar, err := gtk.MenuBarNew()
-	if err != nil {
-		return err
+// fetchTopics asks the server which topics it has, falling back to the
+// built-in ones if it can't be reached
+func fetchTopics(q Quoter) []string {
+	ctx, cancel := withTimeout(requestTimeout)
+	defer cancel()
+	counts, err := q.Topics(ctx)
+	if err != nil || len(counts) == 0 {
+		log.Println("using the built-in topics, couldn't fetch them:", err)
+		return allTopics
 	}
-	g.Add(bar)
-	topics, err := gtk.MenuItemNewWithLabel("Topics")
-	if err != nil {
-		return err
+	names := make([]string, 0, len(counts))
+	for _, c := range counts {
+		names = append(names, c.Topic)
 	}
+	return names
+}
 
+// quoteError returns what to show in place of a quote that couldn't be got
+func quoteError(err error) string {
+	if e, ok := err.(*StatusError); ok && e.StatusCode == http.StatusUnauthorized {
+		return "the token was refused, check it in Edit > Preferences"
+	}
+	if err == ErrNoQuotes && topic != "" {
+		return "there are no quotes on " + topic
+	}
+	if err == ErrNoQuotes {
+		return "there are no quotes"
+	}
+	log.Println("couldn't get a quote:", err)
+	return "couldn't get a quote"
+}
+
+func newTopicMenu(names []string, refresh func()) (*gtk.Menu, error) {
 	topicList, err := gtk.MenuNew()
-	for _, t := range allTopics {
+	if err != nil {
+		return nil, err
+	}
+	anyTopic, err := gtk.MenuItemNewWithLabel("Any topic")
+	if err != nil {
+		return nil, err
+	}
+	anyTopic.Connect("activate", func() {
+		topic = ""
+	})
+	topicList.Append(anyTopic)
+	for _, t := range names {
 		s, err := gtk.MenuItemNewWithLabel(t)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		fixedT := t
 		s.Connect("activate", func() {
@@ -44,19 +86,115 @@ func setupMenuBar(g *gtk.Grid) error {
 		topicList.Append(s)
 	}
 
+	sep, err := gtk.SeparatorMenuItemNew()
+	if err != nil {
+		return nil, err
+	}
+	topicList.Append(sep)
+	r, err := gtk.MenuItemNewWithLabel("Refresh")
+	if err != nil {
+		return nil, err
+	}
+	r.Connect("activate", refresh)
+	topicList.Append(r)
+	return topicList, nil
+}
+
+// setupMenuBar adds the menus, getting topics from the quoter returned by
+// quoter, which changes when the preferences do. It returns a function that
+// refreshes the topics.
+func setupMenuBar(g *gtk.Grid, quoter func() Quoter, preferences func()) (func(), error) {
+	bar, err := gtk.MenuBarNew()
+	if err != nil {
+		return nil, err
+	}
+	g.Add(bar)
+
+	edit, err := gtk.MenuItemNewWithLabel("Edit")
+	if err != nil {
+		return nil, err
+	}
+	editMenu, err := gtk.MenuNew()
+	if err != nil {
+		return nil, err
+	}
+	p, err := gtk.MenuItemNewWithLabel("Preferences")
+	if err != nil {
+		return nil, err
+	}
+	p.Connect("activate", preferences)
+	editMenu.Append(p)
+	edit.SetSubmenu(editMenu)
+	bar.Append(edit)
+
+	topics, err := gtk.MenuItemNewWithLabel("Topics")
+	if err != nil {
+		return nil, err
+	}
+
+	var refresh func()
+	refresh = func() {
+		topicList, err := newTopicMenu(fetchTopics(quoter()), refresh)
+		if err != nil {
+			log.Println("couldn't refresh topics:", err)
+			return
+		}
+		topicList.ShowAll()
+		topics.SetSubmenu(topicList)
+	}
+	topicList, err := newTopicMenu(fetchTopics(quoter()), refresh)
+	if err != nil {
+		return nil, err
+	}
+
 	topics.SetSubmenu(topicList)
 	bar.Append(topics)
-	return nil
+	return refresh, nil
 }
 
-func setupWidgets(w *gtk.Window) error {
+// autoRefresher calls a function every so often, for as long as the
+// interval it was last started with
+type autoRefresher struct {
+	refresh    func()
+	generation int
+}
+
+// start calls refresh every interval from now on, replacing the interval it
+// was started with before. Zero stops it.
+func (a *autoRefresher) start(interval time.Duration) {
+	a.generation++
+	if interval <= 0 {
+		return
+	}
+	generation := a.generation
+	_, err := glib.TimeoutAdd(uint(interval/time.Millisecond), func() bool {
+		// a timer from before the interval changed stops itself
+		if generation != a.generation {
+			return false
+		}
+		a.refresh()
+		return true
+	})
+	if err != nil {
+		log.Println("couldn't refresh quotes automatically:", err)
+	}
+}
+
+func setupWidgets(w *gtk.Window, settings *Settings) error {
 	grid, err := gtk.GridNew()
 	if err != nil {
 		return err
 	}
 	grid.SetOrientation(gtk.ORIENTATION_VERTICAL)
 
-	err = setupMenuBar(grid)
+	q, err := settings.quoter()
+	if err != nil {
+		return err
+	}
+	topic = settings.Topic
+
+	var preferences func()
+	refreshTopics, err := setupMenuBar(grid, func() Quoter { return q }, func() { preferences() })
 	if err != nil {
 		return err
 	}
@@ -86,20 +224,49 @@ func setupWidgets(w *gtk.Window) error {
 	b.SetMarginStart(50)
 	b.SetMarginEnd(50)
 	b.SetMarginBottom(30)
-	q, err := NewHTTPQuoter("http://localhost:8080", "user1")
-	if err != nil {
-		return err
-	}
-	b.Connect("clicked", func() {
-		s, err := q.Quote(topic)
+	showQuote := func() {
+		ctx, cancel := withTimeout(requestTimeout)
+		defer cancel()
+		var s *Quote
+		var err error
+		if topic == "" {
+			s, err = q.RandomQuote(ctx)
+		} else {
+			s, err = q.Quote(ctx, topic)
+		}
 		if err != nil {
-			quote.SetLabel("couldn't get a quote")
+			quote.SetLabel(quoteError(err))
 			author.SetLabel("")
 			return
 		}
 		quote.SetLabel(s.Quote)
 		author.SetLabel("- " + s.Author)
-	})
+	}
+	b.Connect("clicked", showQuote)
+	refresher := &autoRefresher{refresh: showQuote}
+	refresher.start(settings.RefreshInterval)
+
+	preferences = func() {
+		updated, err := runPreferences(w, settings, fetchTopics(q))
+		if err != nil {
+			log.Println("couldn't show the preferences:", err)
+			return
+		}
+		if updated == nil {
+			return
+		}
+		updatedQ, err := updated.quoter()
+		if err != nil {
+			log.Println("couldn't use the new preferences:", err)
+			return
+		}
+		settings, q, topic = updated, updatedQ, updated.Topic
+		refresher.start(settings.RefreshInterval)
+		refreshTopics()
+	}
+	if settings.Token == "" && settings.QuotesFile == "" {
+		quote.SetLabel("Set a token in Edit > Preferences to get quotes")
+	}
 
 	grid.Add(quote)
 	grid.Add(author)
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/gorilla/mux"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Field length limits, matching the VARCHAR sizes of the quote table
+const (
+	maxTopicLength  = 30
+	maxAuthorLength = 255
+	maxTextLength   = 767
+)
+
+// mysqlErrDupEntry is the MySQL error number for a unique key violation
+const mysqlErrDupEntry = 1062
+
+var topicPattern = regexp.MustCompile("^[a-z0-9]+$")
+
+// quoteFields is the body of a request that writes a quote. Fields left out
+// of a PATCH are nil and keep their current value.
+type quoteFields struct {
+	Topic  *string
+	Text   *string
+	Author *string
+}
+
+// apply normalizes the fields that were given and copies them onto the quote
+func (f *quoteFields) apply(quote *Quote) {
+	if f.Topic != nil {
+		quote.Topic = strings.ToLower(strings.TrimSpace(*f.Topic))
+	}
+	if f.Text != nil {
+		quote.Text = strings.TrimSpace(*f.Text)
+	}
+	if f.Author != nil {
+		quote.Author = strings.TrimSpace(*f.Author)
+	}
+}
+
+// complete returns true if every field was given, as a POST or PUT requires
+func (f *quoteFields) complete() bool {
+	return f.Topic != nil && f.Text != nil && f.Author != nil
+}
+
+// validateQuote returns a description of the first thing wrong with the
+// quote, or the empty string if it can be stored
+func validateQuote(quote *Quote) string {
+	switch {
+	case !topicPattern.MatchString(quote.Topic):
+		return "topic must be made up of letters and digits"
+	case utf8.RuneCountInString(quote.Topic) > maxTopicLength:
+		return fmt.Sprintf("topic must be at most %d characters", maxTopicLength)
+	case quote.Author == "":
+		return "author must not be empty"
+	case utf8.RuneCountInString(quote.Author) > maxAuthorLength:
+		return fmt.Sprintf("author must be at most %d characters", maxAuthorLength)
+	case quote.Text == "":
+		return "text must not be empty"
+	case utf8.RuneCountInString(quote.Text) > maxTextLength:
+		return fmt.Sprintf("text must be at most %d characters", maxTextLength)
+	}
+	return ""
+}
+
+// isDuplicate returns true if the error is the database rejecting a write
+// that breaks the (author, text) unique key
+func isDuplicate(err error) bool {
+	switch e := err.(type) {
+	case *mysql.MySQLError:
+		return e.Number == mysqlErrDupEntry
+	case sqlite3.Error:
+		return e.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+	return false
+}
+
+// getQuoteByID looks up a quote, returning errNoQuotes if there isn't one
+func (s *QuoteServer) getQuoteByID(id int64) (*Quote, error) {
+	quote := &Quote{}
+	has, err := s.db.Id(id).Get(quote)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, errNoQuotes
+	}
+	return quote, nil
+}
+
+// hasDuplicate returns true if a quote other than this one already has its
+// author and text
+func (s *QuoteServer) hasDuplicate(quote *Quote) (bool, error) {
+	return s.db.Where("author = ? AND text = ? AND id != ?",
+		quote.Author, quote.Text, quote.ID).Get(&Quote{})
+}
+
+// quotesChangedOrLog calls quotesChanged for each topic. The write has
+// already succeeded at this point, so a failure only means the caller may
+// see stale rotations for a while and isn't worth failing the request over.
+func (s *QuoteServer) quotesChangedOrLog(topics ...string) {
+	for _, topic := range topics {
+		if err := s.quotesChanged(topic); err != nil {
+			fmt.Println("error invalidating topic ", topic, ": ", err)
+		}
+	}
+}
+
+// quoteID parses the ID out of the request's path
+func quoteID(r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	return id, err == nil
+}
+
+// readQuoteFields decodes the request body, writing out a 400 and returning
+// false if it can't be used
+func readQuoteFields(w http.ResponseWriter, r *http.Request, complete bool) (*quoteFields, bool) {
+	fields := &quoteFields{}
+	if err := json.NewDecoder(r.Body).Decode(fields); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if complete && !fields.complete() {
+		http.Error(w, "Topic, Text and Author are all required", http.StatusBadRequest)
+		return nil, false
+	}
+	return fields, true
+}
+
+// GetQuoteByIDHandler is the handler that returns a quote by its ID
+func (s *QuoteServer) GetQuoteByIDHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := quoteID(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	quote, err := s.getQuoteByID(id)
+	returnQuote(w, quote, err)
+}
+
+// CreateQuoteHandler is the handler that adds a new quote
+func (s *QuoteServer) CreateQuoteHandler(w http.ResponseWriter, r *http.Request) {
+	fields, ok := readQuoteFields(w, r, true)
+	if !ok {
+		return
+	}
+	quote := &Quote{}
+	fields.apply(quote)
+	s.storeQuote(w, quote, "", http.StatusCreated)
+}
+
+// UpdateQuoteHandler is the handler that changes an existing quote. A PUT
+// must give every field, while a PATCH only needs the ones being changed.
+func (s *QuoteServer) UpdateQuoteHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := quoteID(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	fields, ok := readQuoteFields(w, r, r.Method == "PUT")
+	if !ok {
+		return
+	}
+	quote, err := s.getQuoteByID(id)
+	if err != nil {
+		returnQuote(w, nil, err)
+		return
+	}
+	oldTopic := quote.Topic
+	fields.apply(quote)
+	s.storeQuote(w, quote, oldTopic, http.StatusOK)
+}
+
+// storeQuote validates and writes out the quote, inserting it if it has no
+// ID yet, and responds with it and the given status code on success
+func (s *QuoteServer) storeQuote(w http.ResponseWriter, quote *Quote, oldTopic string, status int) {
+	if msg := validateQuote(quote); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	dup, err := s.hasDuplicate(quote)
+	if err == nil && dup {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err == nil {
+		if quote.ID == 0 {
+			_, err = s.db.Insert(quote)
+		} else {
+			_, err = s.db.Id(quote.ID).Cols("topic", "text", "author").Update(quote)
+		}
+	}
+	if err == nil {
+		// read it back for the timestamps the database filled in
+		quote, err = s.getQuoteByID(quote.ID)
+	}
+	switch {
+	case isDuplicate(err):
+		// lost a race with another write of the same quote
+		w.WriteHeader(http.StatusConflict)
+		return
+	case err != nil:
+		returnQuote(w, nil, err)
+		return
+	}
+
+	switch oldTopic {
+	case "":
+		s.quotesChangedOrLog(quote.Topic)
+	case quote.Topic:
+		// the author may still have changed
+		s.authorIndex.invalidate()
+	default:
+		s.quotesChangedOrLog(oldTopic, quote.Topic)
+	}
+
+	result, err := json.Marshal(quote)
+	if err != nil {
+		returnQuote(w, nil, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/quotes/id/%d", quote.ID))
+	w.WriteHeader(status)
+	w.Write(result)
+}
+
+// DeleteQuoteHandler is the handler that removes a quote
+func (s *QuoteServer) DeleteQuoteHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := quoteID(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	quote, err := s.getQuoteByID(id)
+	if err != nil {
+		returnQuote(w, nil, err)
+		return
+	}
+	if _, err := s.db.Id(id).Delete(&Quote{}); err != nil {
+		returnQuote(w, nil, err)
+		return
+	}
+	s.quotesChangedOrLog(quote.Topic)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Auth cache defaults. Failed checks are cached for less time so that new
+// tokens start working quickly.
+const (
+	defaultAuthCacheTTL         = 30 * time.Second
+	defaultAuthCacheNegativeTTL = 5 * time.Second
+	defaultAuthCacheSize        = 10000
+)
+
+// authCacheKeyPrefix prefixes the Redis keys of shared auth cache entries
+const authCacheKeyPrefix = "authcache:"
+
+// redisDoer runs a Redis command
+type redisDoer func(cmd string, args ...interface{}) (interface{}, error)
+
+// authCacheEntry is a cached Authenticate result. A nil principal means the
+// token was rejected.
+type authCacheEntry struct {
+	principal *Principal
+	expires   time.Time
+}
+
+// sharedAuthEntry is how an auth cache entry is stored in Redis
+type sharedAuthEntry struct {
+	Valid  bool
+	ID     int64
+	Scopes []string
+}
+
+// AuthCacheStats describes how well the auth cache is doing
+type AuthCacheStats struct {
+	Hits    int64
+	Misses  int64
+	HitRate float64
+	Purges  int64
+	Entries int
+}
+
+// authCache remembers what the auth server said about tokens for a while, so
+// that it isn't asked on every request. Entries are keyed by a hash of the
+// token, so the cache doesn't hold tokens themselves. If shared is set, the
+// entries are also kept in Redis for other quote servers to use.
+type authCache struct {
+	sync.Mutex
+	ttl         time.Duration
+	negativeTTL time.Duration
+	size        int
+	entries     map[string]authCacheEntry
+	shared      redisDoer
+
+	hits, misses, purges int64
+}
+
+func newAuthCache(ttl, negativeTTL time.Duration, size int, shared redisDoer) *authCache {
+	return &authCache{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		size:        size,
+		entries:     make(map[string]authCacheEntry),
+		shared:      shared,
+	}
+}
+
+// authCacheKey returns the key a token is cached under
+func authCacheKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// authCacheIDKey is the Redis key of the set of shared entries for the token
+// with the ID, so they can be found to purge them
+func authCacheIDKey(id int64) string {
+	return authCacheKeyPrefix + "id:" + strconv.FormatInt(id, 10)
+}
+
+// get returns the cached result for the token, and whether there was one
+func (c *authCache) get(token string) (*Principal, bool) {
+	if c.ttl <= 0 {
+		return nil, false
+	}
+	key := authCacheKey(token)
+
+	c.Lock()
+	entry, ok := c.entries[key]
+	if ok && time.Now().Before(entry.expires) {
+		c.hits++
+		c.Unlock()
+		return entry.principal.withToken(token), true
+	}
+	// expired entries are kept until there's no room for them, in case
+	// they are needed by getStale
+	c.Unlock()
+
+	if c.shared != nil {
+		if principal, ok := c.getShared(key); ok {
+			c.Lock()
+			c.hits++
+			c.Unlock()
+			return principal.withToken(token), true
+		}
+	}
+
+	c.Lock()
+	c.misses++
+	c.Unlock()
+	return nil, false
+}
+
+func (c *authCache) getShared(key string) (*Principal, bool) {
+	data, err := redis.Bytes(c.shared("GET", authCacheKeyPrefix+key))
+	if err != nil {
+		if err != redis.ErrNil {
+			fmt.Println("error reading shared auth cache: ", err)
+		}
+		return nil, false
+	}
+	entry := &sharedAuthEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, false
+	}
+	if !entry.Valid {
+		return nil, true
+	}
+	return &Principal{ID: entry.ID, Scopes: entry.Scopes}, true
+}
+
+// getStale returns the principal cached for the token even if the entry has
+// expired, as long as it expired less than maxStale ago. Rejections aren't
+// returned.
+func (c *authCache) getStale(token string, maxStale time.Duration) *Principal {
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.entries[authCacheKey(token)]
+	if !ok || entry.principal == nil || !time.Now().Before(entry.expires.Add(maxStale)) {
+		return nil
+	}
+	return entry.principal.withToken(token)
+}
+
+// put caches the result for the token, for no longer than maxAge if it is
+// positive. A nil principal caches the token being rejected.
+func (c *authCache) put(token string, principal *Principal, maxAge time.Duration) {
+	ttl := c.ttl
+	if principal == nil && c.negativeTTL < ttl {
+		ttl = c.negativeTTL
+	}
+	if maxAge >= 0 && maxAge < ttl {
+		ttl = maxAge
+	}
+	if ttl <= 0 {
+		return
+	}
+	key := authCacheKey(token)
+	now := time.Now()
+
+	c.Lock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		c.evict(now)
+	}
+	c.entries[key] = authCacheEntry{principal: principal.withToken(""), expires: now.Add(ttl)}
+	c.Unlock()
+
+	if c.shared != nil {
+		if err := c.putShared(key, principal, ttl); err != nil {
+			fmt.Println("error writing shared auth cache: ", err)
+		}
+	}
+}
+
+func (c *authCache) putShared(key string, principal *Principal, ttl time.Duration) error {
+	entry := &sharedAuthEntry{}
+	if principal != nil {
+		entry = &sharedAuthEntry{Valid: true, ID: principal.ID, Scopes: principal.Scopes}
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	ms := int64(ttl / time.Millisecond)
+	if _, err := c.shared("SET", authCacheKeyPrefix+key, data, "PX", ms); err != nil {
+		return err
+	}
+	if principal == nil || principal.ID == 0 {
+		return nil
+	}
+	idKey := authCacheIDKey(principal.ID)
+	if _, err := c.shared("SADD", idKey, key); err != nil {
+		return err
+	}
+	// the entries expire on their own, so the index only needs to last as
+	// long as the longest of them could
+	_, err = c.shared("PEXPIRE", idKey, int64(c.ttl/time.Millisecond))
+	return err
+}
+
+// evict makes room for a new entry by dropping expired ones, or if none have
+// expired, an arbitrary one. The caller must hold the lock.
+func (c *authCache) evict(now time.Time) {
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < c.size {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
+
+// purge drops every cached result for the token with the ID, so that a
+// revoked token stops working straight away
+func (c *authCache) purge(id int64) error {
+	c.Lock()
+	c.purges++
+	for key, entry := range c.entries {
+		if entry.principal != nil && entry.principal.ID == id {
+			delete(c.entries, key)
+		}
+	}
+	c.Unlock()
+
+	if c.shared == nil {
+		return nil
+	}
+	idKey := authCacheIDKey(id)
+	keys, err := redis.Strings(c.shared("SMEMBERS", idKey))
+	if err != nil {
+		return err
+	}
+	args := redis.Args{}.Add(idKey)
+	for _, key := range keys {
+		args = args.Add(authCacheKeyPrefix + key)
+	}
+	_, err = c.shared("DEL", args...)
+	return err
+}
+
+// stats returns the cache's hit rate and size
+func (c *authCache) stats() AuthCacheStats {
+	c.Lock()
+	defer c.Unlock()
+	stats := AuthCacheStats{
+		Hits:    c.hits,
+		Misses:  c.misses,
+		Purges:  c.purges,
+		Entries: len(c.entries),
+	}
+	if total := c.hits + c.misses; total > 0 {
+		stats.HitRate = float64(c.hits) / float64(total)
+	}
+	return stats
+}
+
+// maxAge returns how long the response says it may be cached for, or -1 if
+// it doesn't say, and false if it mustn't be cached at all
+func maxAge(header http.Header) (time.Duration, bool) {
+	age := time.Duration(-1)
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-cache", directive == "no-store":
+			return 0, false
+		case strings.HasPrefix(directive, "max-age="):
+			seconds, err := strconv.ParseInt(strings.TrimPrefix(directive, "max-age="), 10, 64)
+			if err != nil || seconds <= 0 {
+				return 0, false
+			}
+			age = time.Duration(seconds) * time.Second
+		}
+	}
+	return age, true
+}
+
+// withToken returns a copy of the principal holding the token, or nil if the
+// principal is nil
+func (p *Principal) withToken(token string) *Principal {
+	if p == nil {
+		return nil
+	}
+	return &Principal{Token: token, ID: p.ID, Scopes: p.Scopes}
+}
+
+// purgeSecretHeader is the header a request to purge the cache carries the
+// purge secret in
+const purgeSecretHeader = "X-Purge-Secret"
+
+// purgeRequest is the body of a request to purge a token from the cache
+type purgeRequest struct {
+	ID int64
+}
+
+// ConfigurePurgeSecret sets the secret the auth server has to send to purge
+// tokens from the auth cache. Without one purging is refused.
+func (s *QuoteServer) ConfigurePurgeSecret(secret string) {
+	s.purgeSecret = secret
+}
+
+// hasPurgeSecret checks that the request carries the purge secret, writing
+// out a 403 if the server hasn't been given one or a 401 if it's wrong
+func (s *QuoteServer) hasPurgeSecret(w http.ResponseWriter, r *http.Request) bool {
+	if s.purgeSecret == "" {
+		http.Error(w, "no purge secret is configured", http.StatusForbidden)
+		return false
+	}
+	secret := r.Header.Get(purgeSecretHeader)
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(s.purgeSecret)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// PurgeAuthCacheHandler is the handler the auth server calls when a token is
+// revoked, to drop what is cached about it. Anyone able to purge could make
+// every request go to the auth server, so the request has to carry the purge
+// secret, and purging is refused when the server hasn't been given one.
+func (s *QuoteServer) PurgeAuthCacheHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.hasPurgeSecret(w, r) {
+		return
+	}
+	req := &purgeRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil || req.ID == 0 {
+		http.Error(w, "a token ID is required", http.StatusBadRequest)
+		return
+	}
+	if err := s.authCache.purge(req.ID); err != nil {
+		fmt.Println("error purging auth cache: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serverMetrics is the body of the metrics response
+type serverMetrics struct {
+	AuthCache AuthCacheStats
+}
+
+// MetricsHandler is the handler that reports how the server is doing. The
+// numbers say how tokens are being used, so like purging it needs the purge
+// secret.
+func (s *QuoteServer) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.hasPurgeSecret(w, r) {
+		return
+	}
+	writeJSON(w, &serverMetrics{AuthCache: s.authCache.stats()})
+}
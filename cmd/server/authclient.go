@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/endophage/quotivational/serve"
+)
+
+// Auth client defaults
+const (
+	defaultAuthConnectTimeout   = 2 * time.Second
+	defaultAuthResponseTimeout  = 5 * time.Second
+	defaultAuthRetries          = 2
+	defaultAuthRetryBackoff     = 100 * time.Millisecond
+	defaultAuthBreakerThreshold = 5
+	defaultAuthBreakerCooldown  = 10 * time.Second
+)
+
+// AuthClientConfig configures how the quote server talks to the auth server
+type AuthClientConfig struct {
+	// ConnectTimeout bounds connecting to the auth server, and
+	// ResponseTimeout bounds waiting for it to answer once connected
+	ConnectTimeout  time.Duration
+	ResponseTimeout time.Duration
+
+	// Retries is how many more times a check that fails for want of an
+	// answer is tried, waiting about RetryBackoff before the first retry
+	// and twice as long before each one after that
+	Retries      int
+	RetryBackoff time.Duration
+
+	// after BreakerThreshold checks in a row fail, the auth server is taken
+	// to be down and isn't asked again until BreakerCooldown has passed
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// FailOpen is how long past its expiry a cached principal may still be
+	// used while the auth server can't be reached. Zero turns it off.
+	FailOpen time.Duration
+
+	// TLS configures HTTPS connections to the auth server, if it isn't the
+	// default
+	TLS *tls.Config
+}
+
+// authTLSConfig returns the TLS configuration for talking to the auth
+// server, trusting the CA certificates in caFile if it's given, and
+// presenting the client certificate in certFile and keyFile if they are, for
+// when the auth server requires one. It returns nil if none are given.
+func authTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := serve.LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// DefaultAuthClientConfig returns the auth client configuration used unless
+// the server is given another
+func DefaultAuthClientConfig() AuthClientConfig {
+	return AuthClientConfig{
+		ConnectTimeout:   defaultAuthConnectTimeout,
+		ResponseTimeout:  defaultAuthResponseTimeout,
+		Retries:          defaultAuthRetries,
+		RetryBackoff:     defaultAuthRetryBackoff,
+		BreakerThreshold: defaultAuthBreakerThreshold,
+		BreakerCooldown:  defaultAuthBreakerCooldown,
+	}
+}
+
+var errBreakerOpen = errors.New("too many failures, waiting before trying again")
+
+// unavailableError means the auth server couldn't be asked about a token, so
+// the request should be tried again after retryAfter
+type unavailableError struct {
+	retryAfter time.Duration
+	err        error
+}
+
+func (e *unavailableError) Error() string {
+	return fmt.Sprintf("auth server unavailable: %s", e.err)
+}
+
+// retryAfterSeconds returns the Retry-After header value for the error
+func (e *unavailableError) retryAfterSeconds() string {
+	seconds := int64((e.retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.FormatInt(seconds, 10)
+}
+
+// authClient asks the auth server about tokens, retrying checks that get no
+// answer and failing fast once it seems to be down
+type authClient struct {
+	client  *http.Client
+	config  AuthClientConfig
+	breaker *circuitBreaker
+}
+
+func newAuthClient(config AuthClientConfig) *authClient {
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		Dial:                  (&net.Dialer{Timeout: config.ConnectTimeout}).Dial,
+		TLSClientConfig:       config.TLS,
+		TLSHandshakeTimeout:   config.ConnectTimeout,
+		ResponseHeaderTimeout: config.ResponseTimeout,
+	}
+	return &authClient{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   config.ConnectTimeout + config.ResponseTimeout,
+		},
+		config:  config,
+		breaker: newCircuitBreaker(config.BreakerThreshold, config.BreakerCooldown),
+	}
+}
+
+// do sends the request made by newRequest, retrying it if there is no answer
+// or the answer is that the auth server is failing. A response is returned
+// for any other answer, and the caller must close its body. Requests must be
+// idempotent to be retried, so each attempt gets a fresh one.
+func (c *authClient) do(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	if ok, wait := c.breaker.allow(); !ok {
+		return nil, &unavailableError{retryAfter: wait, err: errBreakerOpen}
+	}
+
+	var err error
+	backoff := c.config.RetryBackoff
+	for attempt := 0; attempt <= c.config.Retries; attempt++ {
+		if attempt > 0 {
+			// jitter keeps quote servers from retrying in step
+			time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff)+1)))
+			backoff *= 2
+		}
+		var req *http.Request
+		req, err = newRequest()
+		if err != nil {
+			return nil, err
+		}
+		var resp *http.Response
+		resp, err = c.client.Do(req)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			c.breaker.success()
+			return resp, nil
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("%s returned %s", req.URL, resp.Status)
+		}
+	}
+	c.breaker.failure()
+	return nil, &unavailableError{retryAfter: c.config.BreakerCooldown, err: err}
+}
+
+// circuitBreaker tracks failures in a row. Once there are threshold of them
+// it opens, refusing everything for the cooldown, and then lets a single
+// attempt through to find out if things are working again.
+type circuitBreaker struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow returns true if an attempt may be made, or false and how long until
+// one may be
+func (b *circuitBreaker) allow() (bool, time.Duration) {
+	if b.threshold <= 0 {
+		return true, 0
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.failures < b.threshold {
+		return true, 0
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return false, b.openUntil.Sub(now)
+	}
+	// only this attempt goes through until it succeeds or fails
+	b.openUntil = now.Add(b.cooldown)
+	return true, 0
+}
+
+// success closes the breaker
+func (b *circuitBreaker) success() {
+	b.Lock()
+	b.failures = 0
+	b.Unlock()
+}
+
+// failure counts a failure, opening the breaker if there have been enough
+func (b *circuitBreaker) failure() {
+	b.Lock()
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+	b.Unlock()
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// AuthorCount is an author and how many quotes there are by them
+type AuthorCount struct {
+	Author string
+	Count  int64
+}
+
+// AuthorList is a page of authors, in alphabetical order
+type AuthorList struct {
+	Total   int
+	Limit   int
+	Offset  int
+	Authors []AuthorCount
+}
+
+// AuthorQuotes is a page of the quotes by an author
+type AuthorQuotes struct {
+	Author string
+	Total  int
+	Limit  int
+	Offset int
+	Quotes []Quote
+}
+
+// author is every spelling of an author's name that has been stored, along
+// with how many quotes there are by them
+type author struct {
+	key      string
+	name     string
+	variants []string
+	count    int64
+
+	// how many quotes there are under name
+	nameCount int64
+}
+
+// normalizeAuthor returns the form of an author's name used to compare it,
+// so that "Albert Einstein" and "albert  einstein" are the same author
+func normalizeAuthor(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), " ")
+}
+
+// authorIndex keeps every author in memory, as loadAuthors returns them and
+// by normalized name, so that looking one up doesn't group the whole quote
+// table. Like the idCache, it's reloaded after a while to pick up quotes
+// changed behind the server's back.
+type authorIndex struct {
+	sync.Mutex
+	ttl     time.Duration
+	authors []*author
+	byKey   map[string]*author
+	expires time.Time
+}
+
+func newAuthorIndex(ttl time.Duration) *authorIndex {
+	return &authorIndex{ttl: ttl}
+}
+
+// get returns the authors, and the authors by normalized name, calling load
+// to fetch them if they aren't cached or have expired. Neither must be
+// modified.
+func (i *authorIndex) get(load func() ([]*author, error)) ([]*author, map[string]*author, error) {
+	i.Lock()
+	defer i.Unlock()
+
+	if i.byKey != nil && time.Now().Before(i.expires) {
+		return i.authors, i.byKey, nil
+	}
+	authors, err := load()
+	if err != nil {
+		return nil, nil, err
+	}
+	i.authors = authors
+	i.byKey = make(map[string]*author, len(authors))
+	for _, a := range authors {
+		i.byKey[a.key] = a
+	}
+	i.expires = time.Now().Add(i.ttl)
+	return i.authors, i.byKey, nil
+}
+
+// invalidate drops the cached authors
+func (i *authorIndex) invalidate() {
+	i.Lock()
+	defer i.Unlock()
+
+	i.authors, i.byKey = nil, nil
+}
+
+// authors returns every author, sorted by their normalized name
+func (s *QuoteServer) authors() ([]*author, error) {
+	authors, _, err := s.authorIndex.get(s.loadAuthors)
+	return authors, err
+}
+
+// loadAuthors reads every author, grouping spellings of their name that only
+// differ in case and whitespace, sorted by their normalized name. There are
+// far fewer authors than quotes and the grouping can't be done portably in
+// SQL, so it's done here.
+func (s *QuoteServer) loadAuthors() ([]*author, error) {
+	rows, err := s.db.Query("SELECT author, COUNT(*) AS total FROM quote GROUP BY author")
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string]*author)
+	for _, row := range rows {
+		name := string(row["author"])
+		count, err := strconv.ParseInt(string(row["total"]), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		key := normalizeAuthor(name)
+		a, ok := byKey[key]
+		if !ok {
+			a = &author{key: key}
+			byKey[key] = a
+		}
+		a.variants = append(a.variants, name)
+		a.count += count
+		// the spelling with the most quotes is the one shown
+		if count > a.nameCount || (count == a.nameCount && name < a.name) {
+			a.name = name
+			a.nameCount = count
+		}
+	}
+
+	authors := make([]*author, 0, len(byKey))
+	for _, a := range byKey {
+		authors = append(authors, a)
+	}
+	sort.Sort(byAuthorKey(authors))
+	return authors, nil
+}
+
+type byAuthorKey []*author
+
+func (a byAuthorKey) Len() int           { return len(a) }
+func (a byAuthorKey) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byAuthorKey) Less(i, j int) bool { return a[i].key < a[j].key }
+
+// findAuthor returns the author with the given name, or nil if there are no
+// quotes by them
+func (s *QuoteServer) findAuthor(name string) (*author, error) {
+	_, byKey, err := s.authorIndex.get(s.loadAuthors)
+	if err != nil {
+		return nil, err
+	}
+	return byKey[normalizeAuthor(name)], nil
+}
+
+// variantArgs returns the spellings of the author's name as arguments for In
+func (a *author) variantArgs() []interface{} {
+	args := make([]interface{}, 0, len(a.variants))
+	for _, v := range a.variants {
+		args = append(args, v)
+	}
+	return args
+}
+
+// GetAuthorsHandler is the handler that lists authors along with how many
+// quotes there are by each, optionally only those whose name starts with the
+// prefix parameter. Results are paged with the limit and offset parameters.
+func (s *QuoteServer) GetAuthorsHandler(w http.ResponseWriter, r *http.Request) {
+	limit, offset, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	authors, err := s.authors()
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	prefix := normalizeAuthor(r.URL.Query().Get("prefix"))
+	list := &AuthorList{Limit: limit, Offset: offset, Authors: []AuthorCount{}}
+	for _, a := range authors {
+		if !strings.HasPrefix(a.key, prefix) {
+			continue
+		}
+		if list.Total >= offset && len(list.Authors) < limit {
+			list.Authors = append(list.Authors, AuthorCount{Author: a.name, Count: a.count})
+		}
+		list.Total++
+	}
+	writeJSON(w, list)
+}
+
+// GetAuthorQuotesHandler is the handler that lists the quotes by an author,
+// paged with the limit and offset parameters
+func (s *QuoteServer) GetAuthorQuotesHandler(w http.ResponseWriter, r *http.Request) {
+	limit, offset, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	a, err := s.findAuthor(mux.Vars(r)["name"])
+	if err != nil || a == nil {
+		returnQuote(w, nil, orNoQuotes(err))
+		return
+	}
+	quotes := []Quote{}
+	err = s.db.In("author", a.variantArgs()...).Asc("id").Limit(limit, offset).Find(&quotes)
+	if err != nil {
+		returnQuote(w, nil, err)
+		return
+	}
+	writeJSON(w, &AuthorQuotes{
+		Author: a.name,
+		Total:  int(a.count),
+		Limit:  limit,
+		Offset: offset,
+		Quotes: quotes,
+	})
+}
+
+// GetAuthorRandomQuoteHandler is the handler that returns a random quote by
+// an author
+func (s *QuoteServer) GetAuthorRandomQuoteHandler(w http.ResponseWriter, r *http.Request) {
+	a, err := s.findAuthor(mux.Vars(r)["name"])
+	if err != nil || a == nil {
+		returnQuote(w, nil, orNoQuotes(err))
+		return
+	}
+	var quotes []Quote
+	if err := s.db.Cols("id").In("author", a.variantArgs()...).Find(&quotes); err != nil {
+		returnQuote(w, nil, err)
+		return
+	}
+	if len(quotes) == 0 {
+		returnQuote(w, nil, errNoQuotes)
+		return
+	}
+	quote, err := s.getQuoteByID(quotes[rand.Intn(len(quotes))].ID)
+	returnQuote(w, quote, err)
+}
+
+// orNoQuotes returns err, or errNoQuotes if it is nil
+func orNoQuotes(err error) error {
+	if err == nil {
+		return errNoQuotes
+	}
+	return err
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Formats quotes can be imported from and exported to
+const (
+	formatJSONL   = "jsonl"
+	formatCSV     = "csv"
+	formatFortune = "fortune"
+)
+
+// maxImportErrors caps how many failures are described in an importResult,
+// so a file in the wrong format doesn't produce a message per line
+const maxImportErrors = 20
+
+// fortuneAuthor is used for fortune entries that have no attribution line
+const fortuneAuthor = "Anonymous"
+
+// maxLineLength is the longest line accepted in a JSON Lines or fortune file
+const maxLineLength = 1024 * 1024
+
+// maxImportSize is the largest request body an import may have
+const maxImportSize = 8 * 1024 * 1024
+
+var (
+	errImportTooLarge = fmt.Errorf("imports can't be more than %d bytes", maxImportSize)
+	errFortuneTopic   = errors.New("fortune files have no topics, so one has to be given")
+)
+
+// contentTypes are the media types each format is served as
+var contentTypes = map[string]string{
+	formatJSONL:   "application/x-ndjson",
+	formatCSV:     "text/csv; charset=utf-8",
+	formatFortune: "text/plain; charset=utf-8",
+}
+
+// csvHeader is the header row written to, and looked for in, CSV files
+var csvHeader = []string{"topic", "author", "text"}
+
+// importResult reports what happened to each quote in an import
+type importResult struct {
+	Inserted int
+	Skipped  int
+	Failed   int
+	Errors   []string `json:",omitempty"`
+}
+
+func (r *importResult) fail(err error) {
+	r.Failed++
+	if len(r.Errors) < maxImportErrors {
+		r.Errors = append(r.Errors, err.Error())
+	}
+}
+
+// recordError is a problem with a single record, which fails that record
+// but not the rest of the import
+type recordError struct {
+	record int
+	err    error
+}
+
+func (e *recordError) Error() string {
+	return fmt.Sprintf("record %d: %s", e.record, e.err)
+}
+
+// quoteReader reads quotes one at a time, returning io.EOF at the end
+type quoteReader interface {
+	Read() (*Quote, error)
+}
+
+// formatFromName guesses the format of a file from its extension, assuming
+// anything unrecognised is a fortune file since those rarely have one
+func formatFromName(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jsonl", ".json":
+		return formatJSONL
+	case ".csv":
+		return formatCSV
+	}
+	return formatFortune
+}
+
+func newQuoteReader(r io.Reader, format string) (quoteReader, error) {
+	switch format {
+	case formatJSONL:
+		return &jsonlReader{scanner: newLineScanner(r)}, nil
+	case formatCSV:
+		return newCSVReader(r)
+	case formatFortune:
+		return &fortuneReader{scanner: newLineScanner(r)}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineLength)
+	return scanner
+}
+
+// jsonlReader reads a JSON object with the Topic, Text and Author of a quote
+// from each line, skipping blank lines
+type jsonlReader struct {
+	scanner *bufio.Scanner
+	record  int
+}
+
+func (j *jsonlReader) Read() (*Quote, error) {
+	for j.scanner.Scan() {
+		line := strings.TrimSpace(j.scanner.Text())
+		if line == "" {
+			continue
+		}
+		j.record++
+		fields := &quoteFields{}
+		if err := json.Unmarshal([]byte(line), fields); err != nil {
+			return nil, &recordError{j.record, err}
+		}
+		quote := &Quote{}
+		fields.apply(quote)
+		return quote, nil
+	}
+	if err := j.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// csvReader reads quotes from a CSV file whose first row names the topic,
+// author and text columns, in any order
+type csvReader struct {
+	reader  *csv.Reader
+	columns map[string]int
+	record  int
+}
+
+// newCSVReader reads the header row, returning an error if it's missing a
+// column, since none of the rows would be any use then. An empty file has
+// no rows to read.
+func newCSVReader(r io.Reader) (*csvReader, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	c := &csvReader{reader: reader, columns: make(map[string]int)}
+	header, err := reader.Read()
+	if err == io.EOF {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range header {
+		c.columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range csvHeader[1:] {
+		if _, ok := c.columns[name]; !ok {
+			return nil, fmt.Errorf("CSV header has no %q column", name)
+		}
+	}
+	return c, nil
+}
+
+func (c *csvReader) Read() (*Quote, error) {
+	row, err := c.reader.Read()
+	if err != nil {
+		if _, ok := err.(*csv.ParseError); ok {
+			c.record++
+			return nil, &recordError{c.record, err}
+		}
+		return nil, err
+	}
+	c.record++
+	field := func(name string) string {
+		if i, ok := c.columns[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	return &Quote{
+		Topic:  strings.ToLower(field("topic")),
+		Author: field("author"),
+		Text:   field("text"),
+	}, nil
+}
+
+// fortuneReader reads fortune(6) files, in which quotes are separated by
+// lines holding just a %. A last line starting with -- (or an em dash) is
+// taken to be the attribution, as in "\t\t-- Mark Twain".
+type fortuneReader struct {
+	scanner *bufio.Scanner
+	done    bool
+}
+
+func (f *fortuneReader) Read() (*Quote, error) {
+	for !f.done {
+		var lines []string
+		for {
+			if !f.scanner.Scan() {
+				if err := f.scanner.Err(); err != nil {
+					return nil, err
+				}
+				f.done = true
+				break
+			}
+			line := strings.TrimRight(f.scanner.Text(), " \t\r")
+			if line == "%" {
+				break
+			}
+			lines = append(lines, line)
+		}
+		if quote := parseFortune(lines); quote != nil {
+			return quote, nil
+		}
+	}
+	return nil, io.EOF
+}
+
+// parseFortune makes a quote out of the lines of one fortune, or returns nil
+// if they are all blank
+func parseFortune(lines []string) *Quote {
+	author := fortuneAuthor
+	for len(lines) > 0 {
+		last := strings.TrimSpace(lines[len(lines)-1])
+		if last == "" {
+			lines = lines[:len(lines)-1]
+			continue
+		}
+		for _, prefix := range []string{"--", "—", "―"} {
+			if strings.HasPrefix(last, prefix) {
+				author = strings.TrimSpace(strings.TrimPrefix(last, prefix))
+				lines = lines[:len(lines)-1]
+				break
+			}
+		}
+		break
+	}
+	text := strings.TrimSpace(strings.Join(lines, "\n"))
+	if text == "" {
+		return nil
+	}
+	return &Quote{Text: text, Author: author}
+}
+
+// writeQuotes writes the quotes out in the given format
+func writeQuotes(w io.Writer, format string, quotes []Quote) error {
+	switch format {
+	case formatJSONL:
+		enc := json.NewEncoder(w)
+		for _, quote := range quotes {
+			if err := enc.Encode(quoteFields{
+				Topic: &quote.Topic, Text: &quote.Text, Author: &quote.Author,
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	case formatCSV:
+		c := csv.NewWriter(w)
+		c.Write(csvHeader)
+		for _, quote := range quotes {
+			c.Write([]string{quote.Topic, quote.Author, quote.Text})
+		}
+		c.Flush()
+		return c.Error()
+	case formatFortune:
+		for _, quote := range quotes {
+			_, err := fmt.Fprintf(w, "%s\n\t\t-- %s\n%%\n", quote.Text, quote.Author)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// importQuotes reads quotes in the given format and adds those that are
+// valid and not already stored. Quotes with no topic are given defaultTopic.
+// An error is returned if reading the input fails, along with the counts so
+// far; problems with individual quotes are only counted in the result.
+func (s *QuoteServer) importQuotes(r io.Reader, format, defaultTopic string) (*importResult, error) {
+	defaultTopic = strings.ToLower(strings.TrimSpace(defaultTopic))
+	if format == formatFortune && defaultTopic == "" {
+		return nil, errFortuneTopic
+	}
+	reader, err := newQuoteReader(r, format)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &importResult{}
+	changed := make(map[string]bool)
+	defer func() {
+		for topic := range changed {
+			s.quotesChangedOrLog(topic)
+		}
+	}()
+
+	for {
+		quote, err := reader.Read()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			if _, ok := err.(*recordError); ok {
+				result.fail(err)
+				continue
+			}
+			return result, err
+		}
+
+		if quote.Topic == "" {
+			quote.Topic = defaultTopic
+		}
+		if msg := validateQuote(quote); msg != "" {
+			result.fail(fmt.Errorf("%q: %s", quote.Text, msg))
+			continue
+		}
+		dup, err := s.hasDuplicate(quote)
+		if err == nil && !dup {
+			_, err = s.db.Insert(quote)
+			dup = isDuplicate(err)
+		}
+		switch {
+		case dup:
+			result.Skipped++
+		case err != nil:
+			result.fail(fmt.Errorf("%q: %s", quote.Text, err))
+		default:
+			result.Inserted++
+			changed[quote.Topic] = true
+		}
+	}
+}
+
+// exportQuotes writes out the quotes in the topic, or all quotes if the
+// topic is empty, in the given format
+func (s *QuoteServer) exportQuotes(w io.Writer, format, topic string) error {
+	session := s.db.Asc("id")
+	if topic != "" {
+		session = session.Where("topic = ?", strings.ToLower(topic))
+	}
+	var quotes []Quote
+	if err := session.Find(&quotes); err != nil {
+		return err
+	}
+	return writeQuotes(w, format, quotes)
+}
+
+// requestFormat returns the format asked for in the query string, defaulting
+// to JSON Lines
+func requestFormat(r *http.Request) (string, bool) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = formatJSONL
+	}
+	_, ok := contentTypes[format]
+	return format, ok
+}
+
+// ImportQuotesHandler is the handler that adds the quotes in the request
+// body, in the format given by the format parameter. Quotes without a topic
+// are put in the one given by the topic parameter.
+func (s *QuoteServer) ImportQuotesHandler(w http.ResponseWriter, r *http.Request) {
+	format, ok := requestFormat(r)
+	if !ok {
+		http.Error(w, "unknown format", http.StatusBadRequest)
+		return
+	}
+	body := &importLimitReader{r: r.Body, left: maxImportSize}
+	result, err := s.importQuotes(body, format, r.URL.Query().Get("topic"))
+	status := http.StatusOK
+	switch {
+	case err == errImportTooLarge:
+		// what was imported before the limit was reached is still reported
+		status = http.StatusRequestEntityTooLarge
+		if result == nil {
+			result = &importResult{}
+		}
+		result.fail(err)
+	case err != nil && result == nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		// the import stopped part way through, so report what was done
+		result.fail(err)
+	}
+	out, err := json.Marshal(result)
+	if err != nil {
+		returnQuote(w, nil, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+// importLimitReader reads an import, returning errImportTooLarge if it goes
+// on for more than left bytes
+type importLimitReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (l *importLimitReader) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		// it's only too large if there's more to come
+		var b [1]byte
+		if n, err := l.r.Read(b[:]); n == 0 {
+			return 0, err
+		}
+		return 0, errImportTooLarge
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	return n, err
+}
+
+// ExportQuotesHandler is the handler that returns every quote, or just those
+// in the topic given by the topic parameter, in the format given by the
+// format parameter
+func (s *QuoteServer) ExportQuotesHandler(w http.ResponseWriter, r *http.Request) {
+	format, ok := requestFormat(r)
+	if !ok {
+		http.Error(w, "unknown format", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", contentTypes[format])
+	if err := s.exportQuotes(w, format, r.URL.Query().Get("topic")); err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
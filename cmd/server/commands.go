@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// runCommand runs one of the server's subcommands instead of serving
+func runCommand(name string, args []string, dbsource, redisAddr string) error {
+	var run func(*QuoteServer, []string) error
+	switch name {
+	case "import":
+		run = runImport
+	case "export":
+		run = runExport
+	default:
+		return fmt.Errorf("unknown command %q, expected import or export", name)
+	}
+
+	engine, err := setupSQL("mysql", dbsource)
+	if err != nil {
+		return err
+	}
+	defer engine.Close()
+
+	// Redis is only needed to invalidate rotations after an import, so it's
+	// fine to go without if it isn't there
+	var redisPool *redis.Pool
+	if redisAddr != "" {
+		redisPool = newRedisPool(redisAddr, 1, 1, 0)
+		defer redisPool.Close()
+		if err := ping(redisPool); err != nil {
+			fmt.Fprintln(os.Stderr, "not invalidating rotations:", err)
+			redisPool = nil
+		}
+	}
+
+	return run(NewQuoteServer(engine, redisPool, ""), args)
+}
+
+// runImport adds the quotes in each file named, or standard input if none
+// are, and prints how many were inserted, skipped and failed
+func runImport(q *QuoteServer, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "",
+		"jsonl, csv or fortune; guessed from the file extension if not given")
+	topic := flags.String("topic", "", "The topic of quotes that don't have one")
+	flags.Parse(args)
+
+	files := flags.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	total := &importResult{}
+	for _, name := range files {
+		var in io.Reader = os.Stdin
+		var f *os.File
+		fileFormat := *format
+		if name != "-" {
+			var err error
+			f, err = os.Open(name)
+			if err != nil {
+				return err
+			}
+			in = f
+			if fileFormat == "" {
+				fileFormat = formatFromName(name)
+			}
+		} else if fileFormat == "" {
+			fileFormat = formatJSONL
+		}
+
+		result, err := q.importQuotes(in, fileFormat, *topic)
+		if f != nil {
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if result != nil {
+			total.Inserted += result.Inserted
+			total.Skipped += result.Skipped
+			total.Failed += result.Failed
+			for _, msg := range result.Errors {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", name, msg)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+
+	out, err := json.Marshal(total)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// runExport writes out all quotes, or those in one topic, to standard output
+// or a file
+func runExport(q *QuoteServer, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", formatJSONL, "jsonl, csv or fortune")
+	topic := flags.String("topic", "", "Only export quotes in this topic")
+	output := flags.String("o", "-", "The file to write to")
+	flags.Parse(args)
+
+	if *output == "-" {
+		return q.exportQuotes(os.Stdout, *format, *topic)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	// the quotes may not be on disk until the file is closed
+	err = q.exportQuotes(f, *format, *topic)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
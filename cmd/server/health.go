@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Health statuses
+const (
+	statusOK       = "ok"
+	statusDegraded = "degraded"
+	statusDown     = "down"
+	statusDisabled = "disabled"
+)
+
+// dependencyHealth is the state of something the server depends on, how
+// long checking it took, and for Redis, since when it has been in that state
+type dependencyHealth struct {
+	Status    string
+	LatencyMs float64
+	Error     string     `json:",omitempty"`
+	Since     *time.Time `json:",omitempty"`
+}
+
+// healthReport is the body of a health response
+type healthReport struct {
+	Status       string
+	Dependencies map[string]*dependencyHealth `json:",omitempty"`
+}
+
+// checkDependency runs the check, timing it
+func checkDependency(check func() error) *dependencyHealth {
+	start := time.Now()
+	err := check()
+	health := &dependencyHealth{
+		Status:    statusOK,
+		LatencyMs: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		health.Status = statusDown
+		health.Error = err.Error()
+	}
+	return health
+}
+
+// redisHealth checks Redis, recording whether it could be reached
+func (s *QuoteServer) redisHealth() *dependencyHealth {
+	if s.redis == nil {
+		return &dependencyHealth{Status: statusDisabled}
+	}
+	health := checkDependency(s.checkRedis)
+	s.redisState.Lock()
+	since := s.redisState.since
+	s.redisState.Unlock()
+	health.Since = &since
+	return health
+}
+
+// checkAuth checks the auth server says it is alive
+func (s *QuoteServer) checkAuth() error {
+	resp, err := s.auth.client.Get(s.authaddr + "/healthz")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("auth server returned %s", resp.Status)
+	}
+	return nil
+}
+
+// LiveHandler is the handler that reports the server is running
+func (s *QuoteServer) LiveHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, &healthReport{Status: statusOK})
+}
+
+// ReadyHandler is the handler that reports whether the server can serve
+// quotes, checking each of its dependencies at the same time. It can't
+// without the database or the auth server. Without Redis it still can, but
+// it is degraded, since quotes are picked at random rather than from those
+// the caller hasn't seen.
+func (s *QuoteServer) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]func() *dependencyHealth{
+		"database": func() *dependencyHealth { return checkDependency(s.db.Ping) },
+		"redis":    s.redisHealth,
+		"auth":     func() *dependencyHealth { return checkDependency(s.checkAuth) },
+	}
+	report := &healthReport{Status: statusOK, Dependencies: make(map[string]*dependencyHealth)}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func() *dependencyHealth) {
+			defer wg.Done()
+			health := check()
+			lock.Lock()
+			report.Dependencies[name] = health
+			lock.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	switch {
+	case report.Dependencies["database"].Status == statusDown, report.Dependencies["auth"].Status == statusDown:
+		report.Status = statusDown
+		status = http.StatusServiceUnavailable
+	case report.Dependencies["redis"].Status == statusDown:
+		report.Status = statusDegraded
+	}
+	body, err := json.Marshal(report)
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
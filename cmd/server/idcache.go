@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// idCacheTTL is how long a topic's quote IDs are trusted before they are
+// reloaded, which bounds how long quotes changed behind the server's back
+// (e.g. straight in the database, or by another replica) go unnoticed
+const idCacheTTL = time.Minute
+
+// idCache keeps the quote IDs of each topic in memory, so that picking a
+// random quote is a primary key lookup of a random ID instead of an
+// ORDER BY RAND() over the whole table, which is neither portable across
+// SQL dialects nor cheap on large tables
+type idCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[string]idCacheEntry
+}
+
+type idCacheEntry struct {
+	ids     []int64
+	expires time.Time
+}
+
+func newIDCache(ttl time.Duration) *idCache {
+	return &idCache{ttl: ttl, entries: make(map[string]idCacheEntry)}
+}
+
+// get returns the cached IDs for the topic, calling load to fetch them if
+// they aren't cached or have expired. The returned slice must not be modified.
+func (c *idCache) get(topic string, load func(string) ([]int64, error)) ([]int64, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if entry, ok := c.entries[topic]; ok && time.Now().Before(entry.expires) {
+		return entry.ids, nil
+	}
+	ids, err := load(topic)
+	if err != nil {
+		return nil, err
+	}
+	c.entries[topic] = idCacheEntry{ids: ids, expires: time.Now().Add(c.ttl)}
+	return ids, nil
+}
+
+// invalidate drops the cached IDs for the topic and for all quotes
+func (c *idCache) invalidate(topic string) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.entries, topic)
+	delete(c.entries, "")
+}
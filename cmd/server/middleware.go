@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/context"
+)
+
+// contextKey is the type of the keys the server stores in request contexts
+type contextKey int
+
+// principalKey is the context key of who a request was authenticated as
+const principalKey contextKey = iota
+
+// requestToken returns the auth token the request carries, either in the
+// x-auth-token header or as a bearer token in the Authorization header
+func requestToken(r *http.Request) string {
+	if token := r.Header.Get("x-auth-token"); token != "" {
+		return token
+	}
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len("bearer ") && strings.EqualFold(auth[:len("bearer ")], "bearer ") {
+		return strings.TrimSpace(auth[len("bearer "):])
+	}
+	return ""
+}
+
+// requireScope wraps the handler so it is only called for requests that carry
+// a valid token granted the scope, with who the request was authenticated as
+// available from principalFrom. Other requests get a 401, or a 403 if the
+// token doesn't have the scope, or a 503 if the auth server can't be asked.
+// Requests over their rate limit get a 429. The client's IP is limited before
+// the token is checked, so that made up tokens can't be used to flood the
+// auth server, and then the token is limited by its scopes.
+func (s *QuoteServer) requireScope(scope string, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.allowRequest(w, r, nil) {
+			return
+		}
+		principal, err := s.Authenticate(requestToken(r))
+		if unavailable, ok := err.(*unavailableError); ok {
+			fmt.Println("error authenticating: ", err)
+			w.Header().Set("Retry-After", unavailable.retryAfterSeconds())
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			fmt.Println("error authenticating: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if principal == nil {
+			fmt.Println("unauthorized: ", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !s.allowRequest(w, r, principal) {
+			return
+		}
+		if !principal.HasScope(scope) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		// the router clears the context once the request is done
+		context.Set(r, principalKey, principal)
+		handler(w, r)
+	})
+}
+
+// principalFrom returns who the request was authenticated as, or nil if it
+// didn't go through requireScope
+func principalFrom(r *http.Request) *Principal {
+	principal, _ := context.Get(r, principalKey).(*Principal)
+	return principal
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// anonymousScope is the rate limit scope of client IPs, which every request
+// is limited by before its token is checked
+const anonymousScope = "anonymous"
+
+// rateLimitKeyPrefix prefixes the Redis keys of rate limit buckets
+const rateLimitKeyPrefix = "ratelimit:"
+
+// RateLimit allows Requests requests every Period, and bursts of up to
+// Requests at a time
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// String returns the limit as it is given on the command line
+func (l RateLimit) String() string {
+	return fmt.Sprintf("%d/%s", l.Requests, l.Period)
+}
+
+// perMilli returns how many requests the limit allows each millisecond
+func (l RateLimit) perMilli() float64 {
+	return float64(l.Requests) / float64(l.Period/time.Millisecond)
+}
+
+// parseRateLimit parses a limit such as 60/1m
+func parseRateLimit(s string) (RateLimit, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return RateLimit{}, fmt.Errorf("rate limit %q is not requests/period", s)
+	}
+	requests, err := strconv.Atoi(parts[0])
+	if err != nil || requests < 1 {
+		return RateLimit{}, fmt.Errorf("rate limit %q needs a positive number of requests", s)
+	}
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period < time.Millisecond {
+		return RateLimit{}, fmt.Errorf("rate limit %q needs a period of at least 1ms", s)
+	}
+	return RateLimit{Requests: requests, Period: period}, nil
+}
+
+// rateLimitFlag collects rate limits given on the command line as
+// scope=requests/period, one per flag
+type rateLimitFlag map[string]RateLimit
+
+func (f rateLimitFlag) String() string {
+	return strings.Join(f.Values(), " ")
+}
+
+// Values returns the limits as they are given on the command line, so that
+// they can also be given as a list in a config file
+func (f rateLimitFlag) Values() []string {
+	limits := []string{}
+	for scope, limit := range f {
+		limits = append(limits, scope+"="+limit.String())
+	}
+	sort.Strings(limits)
+	return limits
+}
+
+func (f rateLimitFlag) Set(value string) error {
+	i := strings.LastIndex(value, "=")
+	if i < 1 {
+		return fmt.Errorf("%q is not scope=requests/period", value)
+	}
+	limit, err := parseRateLimit(value[i+1:])
+	if err != nil {
+		return err
+	}
+	f[value[:i]] = limit
+	return nil
+}
+
+// takeTokenScript takes a token from a bucket, refilling it for the time
+// since it was last used. It returns 1 if a token was taken and 0 if not,
+// the whole tokens left, the milliseconds until a token will be available,
+// and the milliseconds until the bucket is full again. The time is passed
+// in, since scripts that write can't read the clock.
+var takeTokenScript = redis.NewScript(1, `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+local taken = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	taken = 1
+else
+	wait = math.ceil((1 - tokens) / rate)
+end
+local full = math.ceil((burst - tokens) / rate)
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+redis.call("PEXPIRE", KEYS[1], full + 1)
+return {taken, math.floor(tokens), wait, full}
+`)
+
+// rateLimitKey returns the Redis key of the bucket for the token, or for the
+// client's IP if there's no token. Tokens are hashed to keep them out of
+// Redis.
+func rateLimitKey(principal *Principal, r *http.Request) string {
+	if principal != nil {
+		return rateLimitKeyPrefix + "token:" + authCacheKey(principal.Token)
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return rateLimitKeyPrefix + "ip:" + ip
+}
+
+// rateLimitFor returns the limit for the principal, which is the most
+// generous of the limits for its scopes, or for client IPs if the
+// principal is nil. False means there is no limit.
+func (s *QuoteServer) rateLimitFor(principal *Principal) (RateLimit, bool) {
+	if principal == nil {
+		limit, ok := s.rateLimits[anonymousScope]
+		return limit, ok
+	}
+	var best RateLimit
+	found := false
+	for _, scope := range principal.Scopes {
+		limit, ok := s.rateLimits[scope]
+		if ok && (!found || limit.perMilli() > best.perMilli()) {
+			best, found = limit, true
+		}
+	}
+	return best, found
+}
+
+// allowRequest takes a token from the bucket for the request, setting the
+// X-RateLimit headers. If the bucket is empty it responds with a 429 and
+// returns false. Limits need Redis, so that they hold across quote servers,
+// and requests are let through while it can't be used.
+func (s *QuoteServer) allowRequest(w http.ResponseWriter, r *http.Request, principal *Principal) bool {
+	limit, ok := s.rateLimitFor(principal)
+	if !ok || !s.redisAvailable() {
+		return true
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	conn := s.redis.Get()
+	reply, err := redis.Ints(takeTokenScript.Do(conn,
+		rateLimitKey(principal, r), limit.perMilli(), limit.Requests, now))
+	conn.Close()
+	if err == nil && len(reply) != 4 {
+		err = fmt.Errorf("unexpected rate limit reply %v", reply)
+	}
+	if err != nil {
+		fmt.Println("error checking rate limit: ", err)
+		return true
+	}
+	taken, remaining, wait, full := reply[0], reply[1], reply[2], reply[3]
+
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Requests))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(millisToSeconds(full)))
+	if taken == 1 {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(millisToSeconds(wait)))
+	w.WriteHeader(http.StatusTooManyRequests)
+	return false
+}
+
+// millisToSeconds rounds milliseconds up to whole seconds
+func millisToSeconds(ms int) int {
+	return (ms + 999) / 1000
+}
+
+// ConfigureRateLimits sets the rate limits for tokens with each scope, and
+// for anonymousScope, which applies to each client IP whether or not its
+// requests carry a token. Tokens without a limit for any of their scopes
+// aren't limited.
+func (s *QuoteServer) ConfigureRateLimits(limits map[string]RateLimit) {
+	s.rateLimits = limits
+}
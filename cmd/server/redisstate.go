@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// redisCheckInterval is how often Redis is checked, so that the server
+// notices when it goes away or comes back
+const redisCheckInterval = 5 * time.Second
+
+var errRedisDown = errors.New("redis is unavailable")
+
+// redisState is whether Redis could be reached when it was last used or
+// checked. While it can't, quotes are picked at random instead of from the
+// unseen sets, and nothing else that needs Redis is tried.
+type redisState struct {
+	sync.Mutex
+	up    bool
+	since time.Time
+	err   error
+}
+
+// redisAvailable returns true if the server has Redis and it was reachable
+// when last checked
+func (s *QuoteServer) redisAvailable() bool {
+	if s.redis == nil {
+		return false
+	}
+	s.redisState.Lock()
+	defer s.redisState.Unlock()
+	return s.redisState.up
+}
+
+// checkRedis pings Redis and records whether it answered
+func (s *QuoteServer) checkRedis() error {
+	err := ping(s.redis)
+	state := &s.redisState
+	state.Lock()
+	defer state.Unlock()
+	if up := err == nil; up != state.up || state.since.IsZero() {
+		if up {
+			fmt.Println("redis is available")
+		} else {
+			fmt.Println("redis is unavailable, picking quotes at random: ", err)
+		}
+		state.up = up
+		state.since = time.Now()
+	}
+	state.err = err
+	return err
+}
+
+// watchRedis checks Redis every interval, for as long as the server runs.
+// The pool reconnects by itself, so this is only to notice when it can be
+// used again.
+func (s *QuoteServer) watchRedis(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.checkRedis()
+	}
+}
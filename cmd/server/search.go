@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/go-xorm/xorm"
+)
+
+// Paging limits for search results
+const (
+	defaultSearchLimit = 10
+	maxSearchLimit     = 100
+
+	// maxSQLiteCandidates is how many matches SQLite searches score, since
+	// they have to be scored in Go. Matches past it are counted but never
+	// returned.
+	maxSQLiteCandidates = 1000
+)
+
+// mysqlFulltextIndex is the name of the FULLTEXT index on the quote text
+const mysqlFulltextIndex = "text_fulltext"
+
+// likeEscaper escapes the wildcards in a LIKE pattern, using ! as the escape
+// character because it means the same thing to MySQL and SQLite
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// sqliteSearchSchema keeps an FTS4 index of the quote text alongside the
+// quote table, kept up to date by triggers
+var sqliteSearchSchema = []string{
+	`CREATE VIRTUAL TABLE IF NOT EXISTS quote_fts USING fts4(content="quote", text)`,
+	`CREATE TRIGGER IF NOT EXISTS quote_fts_bu BEFORE UPDATE ON quote BEGIN
+		DELETE FROM quote_fts WHERE docid = old.id;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS quote_fts_bd BEFORE DELETE ON quote BEGIN
+		DELETE FROM quote_fts WHERE docid = old.id;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS quote_fts_au AFTER UPDATE ON quote BEGIN
+		INSERT INTO quote_fts (docid, text) VALUES (new.id, new.text);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS quote_fts_ai AFTER INSERT ON quote BEGIN
+		INSERT INTO quote_fts (docid, text) VALUES (new.id, new.text);
+	END`,
+}
+
+// searchQuery is what to search for, and which page of results to return
+type searchQuery struct {
+	Terms  []string
+	Author string
+	Topic  string
+	Limit  int
+	Offset int
+}
+
+// searchHit is a quote's ID and how well it matched
+type searchHit struct {
+	id    int64
+	score float64
+}
+
+// Highlight is the byte offset and length of a matched word in a quote's text
+type Highlight struct {
+	Start  int
+	Length int
+}
+
+// SearchResult is a quote that matched a search
+type SearchResult struct {
+	Quote      *Quote
+	Score      float64
+	Highlights []Highlight
+}
+
+// SearchResults is a page of search results, best match first
+type SearchResults struct {
+	Total   int
+	Limit   int
+	Offset  int
+	Results []SearchResult
+}
+
+// setupSearch creates whatever the database needs for full text search
+func setupSearch(engine *xorm.Engine, dbtype string) error {
+	switch dbtype {
+	case "mysql":
+		indexes, err := engine.Query("SHOW INDEX FROM quote WHERE Key_name = ?",
+			mysqlFulltextIndex)
+		if err != nil || len(indexes) > 0 {
+			return err
+		}
+		_, err = engine.Exec(fmt.Sprintf("ALTER TABLE quote ADD FULLTEXT INDEX %s (text)",
+			mysqlFulltextIndex))
+		return err
+	case "sqlite3":
+		has, err := engine.IsTableExist("quote_fts")
+		if err != nil {
+			return err
+		}
+		for _, stmt := range sqliteSearchSchema {
+			if _, err := engine.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		if !has {
+			// index any quotes that were there before the index was
+			_, err = engine.Exec("INSERT INTO quote_fts (quote_fts) VALUES ('rebuild')")
+		}
+		return err
+	}
+	return nil
+}
+
+// searchTerms splits a search string into the words to look for, each made up
+// only of letters and digits so they can't be read as search syntax
+func searchTerms(q string) []string {
+	return strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// highlights finds the words in the text that match a search term
+func highlights(text string, terms []string) []Highlight {
+	want := make(map[string]bool, len(terms))
+	for _, term := range terms {
+		want[term] = true
+	}
+	found := []Highlight{}
+	start := -1
+	for i, r := range text + " " {
+		isWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case isWord && start < 0:
+			start = i
+		case !isWord && start >= 0:
+			if want[strings.ToLower(text[start:i])] {
+				found = append(found, Highlight{Start: start, Length: i - start})
+			}
+			start = -1
+		}
+	}
+	return found
+}
+
+// searchFilters returns the SQL conditions and arguments restricting a
+// search to the author and topic asked for
+func searchFilters(sq *searchQuery) (string, []interface{}) {
+	var (
+		where string
+		args  []interface{}
+	)
+	if sq.Topic != "" {
+		where += " AND quote.topic = ?"
+		args = append(args, sq.Topic)
+	}
+	if sq.Author != "" {
+		where += " AND quote.author LIKE ? ESCAPE '!'"
+		args = append(args, "%"+likeEscaper.Replace(sq.Author)+"%")
+	}
+	return where, args
+}
+
+// searchMySQL ranks matches with the FULLTEXT index's relevance score,
+// letting the database do the paging
+func (s *QuoteServer) searchMySQL(sq *searchQuery) ([]searchHit, int, error) {
+	match := "MATCH (quote.text) AGAINST (? IN NATURAL LANGUAGE MODE)"
+	against := strings.Join(sq.Terms, " ")
+	filters, filterArgs := searchFilters(sq)
+
+	args := append([]interface{}{against}, filterArgs...)
+	counts, err := s.db.Query("SELECT COUNT(*) AS total FROM quote WHERE "+
+		match+filters, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	total, _ := strconv.Atoi(string(counts[0]["total"]))
+
+	args = append([]interface{}{against, against}, filterArgs...)
+	args = append(args, sq.Limit, sq.Offset)
+	rows, err := s.db.Query("SELECT quote.id AS id, "+match+" AS score FROM quote WHERE "+
+		match+filters+" ORDER BY score DESC, quote.id LIMIT ? OFFSET ?", args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	hits := make([]searchHit, 0, len(rows))
+	for _, row := range rows {
+		id, err := strconv.ParseInt(string(row["id"]), 10, 64)
+		if err != nil {
+			return nil, 0, err
+		}
+		score, _ := strconv.ParseFloat(string(row["score"]), 64)
+		hits = append(hits, searchHit{id: id, score: score})
+	}
+	return hits, total, nil
+}
+
+// searchSQLite finds matches with the FTS4 index. FTS4 has no ranking of its
+// own, so matches are scored here by TF-IDF from matchinfo and paged in Go,
+// which is why only the first maxSQLiteCandidates of them are scored.
+func (s *QuoteServer) searchSQLite(sq *searchQuery) ([]searchHit, int, error) {
+	from := "FROM quote_fts JOIN quote ON quote.id = quote_fts.docid WHERE quote_fts MATCH ?"
+	filters, filterArgs := searchFilters(sq)
+	args := append([]interface{}{strings.Join(sq.Terms, " OR ")}, filterArgs...)
+	counts, err := s.db.Query("SELECT COUNT(*) AS total "+from+filters, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	total, _ := strconv.Atoi(string(counts[0]["total"]))
+	if sq.Offset >= total || sq.Offset >= maxSQLiteCandidates {
+		return nil, total, nil
+	}
+
+	args = append(args, maxSQLiteCandidates)
+	rows, err := s.db.Query("SELECT quote.id AS id, matchinfo(quote_fts, 'pcnx') AS info "+
+		from+filters+" ORDER BY quote.id LIMIT ?", args...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	hits := make([]searchHit, 0, len(rows))
+	for _, row := range rows {
+		id, err := strconv.ParseInt(string(row["id"]), 10, 64)
+		if err != nil {
+			return nil, 0, err
+		}
+		hits = append(hits, searchHit{id: id, score: matchinfoScore(row["info"])})
+	}
+	sort.Sort(byScore(hits))
+
+	if sq.Offset >= len(hits) {
+		return nil, total, nil
+	}
+	hits = hits[sq.Offset:]
+	if len(hits) > sq.Limit {
+		hits = hits[:sq.Limit]
+	}
+	return hits, total, nil
+}
+
+// matchinfoScore scores a row from its FTS4 matchinfo 'pcnx' blob, which is
+// an array of unsigned 32 bit integers in the machine's byte order (assumed
+// to be little endian): the number of phrases and columns, the number of
+// rows, and then for each phrase and column the hits in this row, the hits in
+// all rows and the number of rows with a hit
+func matchinfoScore(info []byte) float64 {
+	ints := make([]uint32, len(info)/4)
+	for i := range ints {
+		ints[i] = binary.LittleEndian.Uint32(info[i*4:])
+	}
+	if len(ints) < 3 {
+		return 0
+	}
+	phrases, columns, rows := int(ints[0]), int(ints[1]), float64(ints[2])
+	score := 0.0
+	for i := 0; i < phrases*columns && 3+i*3+2 < len(ints); i++ {
+		hits, rowsWithHits := float64(ints[3+i*3]), float64(ints[3+i*3+2])
+		if hits > 0 && rowsWithHits > 0 {
+			score += hits * math.Log(1+rows/rowsWithHits)
+		}
+	}
+	return score
+}
+
+type byScore []searchHit
+
+func (h byScore) Len() int      { return len(h) }
+func (h byScore) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h byScore) Less(i, j int) bool {
+	if h[i].score != h[j].score {
+		return h[i].score > h[j].score
+	}
+	return h[i].id < h[j].id
+}
+
+// search returns a page of the quotes matching the query, best first
+func (s *QuoteServer) search(sq *searchQuery) (*SearchResults, error) {
+	var (
+		hits  []searchHit
+		total int
+		err   error
+	)
+	switch s.db.DriverName() {
+	case "sqlite3":
+		hits, total, err = s.searchSQLite(sq)
+	default:
+		hits, total, err = s.searchMySQL(sq)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	results := &SearchResults{Total: total, Limit: sq.Limit, Offset: sq.Offset,
+		Results: make([]SearchResult, 0, len(hits))}
+	if len(hits) == 0 {
+		return results, nil
+	}
+	ids := make([]interface{}, 0, len(hits))
+	for _, hit := range hits {
+		ids = append(ids, hit.id)
+	}
+	quotes := make(map[int64]*Quote, len(hits))
+	if err := s.db.In("id", ids...).Find(&quotes); err != nil {
+		return nil, err
+	}
+	for _, hit := range hits {
+		quote, ok := quotes[hit.id]
+		if !ok {
+			// deleted since the search
+			continue
+		}
+		results.Results = append(results.Results, SearchResult{
+			Quote:      quote,
+			Score:      hit.score,
+			Highlights: highlights(quote.Text, sq.Terms),
+		})
+	}
+	return results, nil
+}
+
+// intParam reads a non-negative integer query parameter
+func intParam(r *http.Request, name string, def int) (int, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, true
+	}
+	i, err := strconv.Atoi(v)
+	return i, err == nil && i >= 0
+}
+
+// pageParams reads the limit and offset query parameters, writing out a 400
+// and returning false if they are invalid
+func pageParams(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	limit, ok := intParam(r, "limit", defaultSearchLimit)
+	if !ok || limit == 0 {
+		http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+	offset, ok := intParam(r, "offset", 0)
+	if !ok {
+		http.Error(w, "offset must be a number", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return limit, offset, true
+}
+
+// writeJSON writes out v as JSON, or a 500 if it can't be
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// SearchQuotesHandler is the handler that searches the text of quotes for
+// the words in the q parameter, optionally only those whose author contains
+// the author parameter and that are in the topic parameter. Results are
+// paged with the limit and offset parameters.
+func (s *QuoteServer) SearchQuotesHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	sq := &searchQuery{
+		Terms:  searchTerms(params.Get("q")),
+		Author: strings.TrimSpace(params.Get("author")),
+		Topic:  strings.ToLower(strings.TrimSpace(params.Get("topic"))),
+	}
+	if len(sq.Terms) == 0 {
+		http.Error(w, "q must have at least one word to search for", http.StatusBadRequest)
+		return
+	}
+	var ok bool
+	if sq.Limit, sq.Offset, ok = pageParams(w, r); !ok {
+		return
+	}
+
+	results, err := s.search(sq)
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, results)
+}
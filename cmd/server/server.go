@@ -2,12 +2,17 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"math/rand"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
+	"github.com/endophage/quotivational/config"
+	"github.com/endophage/quotivational/serve"
 	"github.com/garyburd/redigo/redis"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/go-xorm/xorm"
@@ -17,7 +22,7 @@ import (
 
 // Quote encapsulates a quote
 type Quote struct {
-	ID      int64     `xorm:"id" json:"-"`
+	ID      int64     `xorm:"id"`
 	Topic   string    `xorm:"topic"`
 	Text    string    `xorm:"text"`
 	Author  string    `xorm:"author"`
@@ -25,55 +30,189 @@ type Quote struct {
 	Updated time.Time `xorm:"updated" json:"-"`
 }
 
+// Redis connection pool defaults
+const (
+	defaultRedisMaxIdle     = 8
+	defaultRedisMaxActive   = 64
+	defaultRedisIdleTimeout = 4 * time.Minute
+	redisDialTimeout        = 5 * time.Second
+	redisIOTimeout          = 5 * time.Second
+
+	// redisPingAfter is how long a connection may sit idle before it is
+	// checked with a PING when it's next borrowed
+	redisPingAfter = 5 * time.Second
+)
+
+// maxRefillAttempts bounds how many times a refill of a token's unseen set
+// is retried when a concurrent request for the same token keeps winning
+const maxRefillAttempts = 5
+
+// maxUnseenDraws bounds how many quotes that no longer exist, or are no
+// longer in the topic, a draw skips before giving up
+const maxUnseenDraws = 10
+
+var (
+	errNoQuotes         = errors.New("no quotes available")
+	errRefillContention = errors.New("gave up refilling unseen quotes")
+)
+
 // QuoteServer sets up the quote server
 type QuoteServer struct {
-	db       *xorm.Engine
-	redis    redis.Conn
-	authaddr string
+	db        *xorm.Engine
+	redis     *redis.Pool
+	authaddr  string
+	ids       *idCache
+	auth      *authClient
+	signed    *signedTokens
+	authCache *authCache
+
+	// authorIndex caches the authors, as ids does the quote IDs
+	authorIndex *authorIndex
+
+	// purgeSecret is what the auth server sends to purge the auth cache
+	purgeSecret string
+
+	// rateLimits are the limits for tokens with each scope
+	rateLimits map[string]RateLimit
+
+	redisState redisState
 }
 
-// NewQuoteServer is a constructor for QuoteServer
-func NewQuoteServer(db *xorm.Engine, redisConn redis.Conn, authaddr string) *QuoteServer {
-	return &QuoteServer{db: db, redis: redisConn,
-		authaddr: strings.TrimSuffix(authaddr, "/")}
+// NewQuoteServer is a constructor for QuoteServer. The Redis pool may be nil,
+// in which case quotes are picked without regard to what has been seen.
+func NewQuoteServer(db *xorm.Engine, redisPool *redis.Pool, authaddr string) *QuoteServer {
+	authaddr = strings.TrimSuffix(authaddr, "/")
+	auth := newAuthClient(DefaultAuthClientConfig())
+	return &QuoteServer{db: db, redis: redisPool,
+		authaddr:    authaddr,
+		ids:         newIDCache(idCacheTTL),
+		authorIndex: newAuthorIndex(idCacheTTL),
+		auth:        auth,
+		signed:      newSignedTokens(authaddr, auth.client),
+		authCache:   newAuthCache(defaultAuthCacheTTL, defaultAuthCacheNegativeTTL, defaultAuthCacheSize, nil),
+		redisState:  redisState{up: redisPool != nil}}
 }
 
-// GetQuoteHandler is the handler that returns the quotes
-func (s *QuoteServer) GetQuoteHandler(w http.ResponseWriter, r *http.Request) {
-	key := r.Header.Get("x-auth-token")
-	authed, err := s.Authenticate(key)
-	if err != nil {
-		fmt.Println("error authenticating: ", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+// ConfigureAuthClient sets the timeouts, retries and circuit breaking used
+// when talking to the auth server
+func (s *QuoteServer) ConfigureAuthClient(config AuthClientConfig) {
+	s.auth = newAuthClient(config)
+	s.signed = newSignedTokens(s.authaddr, s.auth.client)
+}
+
+// ConfigureAuthCache sets how long the auth server's answers are cached for,
+// and how many of them, replacing anything already cached. A ttl of zero
+// turns the cache off. If shared is true the cache is also kept in Redis, so
+// that quote servers share it.
+func (s *QuoteServer) ConfigureAuthCache(ttl, negativeTTL time.Duration, size int, shared bool) {
+	var do redisDoer
+	if shared && s.redis != nil {
+		do = s.redisDo
 	}
-	if !authed {
-		fmt.Println("unauthorized: ", key)
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+	s.authCache = newAuthCache(ttl, negativeTTL, size, do)
+}
+
+// redisDo runs a Redis command on a connection from the pool
+func (s *QuoteServer) redisDo(cmd string, args ...interface{}) (interface{}, error) {
+	if !s.redisAvailable() {
+		return nil, errRedisDown
 	}
+	conn := s.redis.Get()
+	defer conn.Close()
+	return conn.Do(cmd, args...)
+}
+
+// newRedisPool returns a pool of connections to Redis at addr. Connections
+// are made as they are needed, so the pool reconnects once Redis comes back
+// after going away, and those left idle are checked before being used again.
+func newRedisPool(addr string, maxIdle, maxActive int, idleTimeout time.Duration) *redis.Pool {
+	return &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.DialTimeout("tcp", addr, redisDialTimeout, redisIOTimeout, redisIOTimeout)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < redisPingAfter {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+		MaxIdle:     maxIdle,
+		MaxActive:   maxActive,
+		IdleTimeout: idleTimeout,
+		// wait for a connection rather than fail when MaxActive are in use
+		Wait: true,
+	}
+}
 
+// GetQuoteHandler is the handler that returns the quotes
+func (s *QuoteServer) GetQuoteHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	topic := vars["topic"]
 	topic = strings.ToLower(topic)
-	s.returnQuoteByTopic(w, topic)
+	s.returnQuoteByTopic(w, principalFrom(r).Token, topic)
+}
+
+func (s *QuoteServer) returnQuoteByTopic(w http.ResponseWriter, token, topic string) {
+	var (
+		quote *Quote
+		err   error
+	)
+	if !s.redisAvailable() {
+		quote, err = s.randomQuote(topic)
+	} else {
+		quote, err = s.nextUnseenQuote(token, topic)
+		if err != nil && err != errNoQuotes && s.checkRedis() != nil {
+			// Redis went away, which shouldn't stop quotes being served
+			quote, err = s.randomQuote(topic)
+		}
+	}
+	returnQuote(w, quote, err)
+}
+
+// GetRandomQuoteHandler is the handler that looks up what quotes have been
+// seen so far and returns one that hasn't been seen lately
+func (s *QuoteServer) GetRandomQuoteHandler(w http.ResponseWriter, r *http.Request) {
+	s.returnQuoteByTopic(w, principalFrom(r).Token, "")
+}
+
+// topicCount is how many quotes there are in a topic
+type topicCount struct {
+	Topic string `xorm:"topic"`
+	Count int64  `xorm:"total"`
 }
 
-func (s *QuoteServer) returnQuoteByTopic(w http.ResponseWriter, topic string) {
-	quote := &Quote{}
-	has, err := s.db.Where("topic = ?", topic).OrderBy("RAND()").Get(quote)
+// GetTopicsHandler is the handler that lists every topic along with how many
+// quotes are in it
+func (s *QuoteServer) GetTopicsHandler(w http.ResponseWriter, r *http.Request) {
+	counts := []topicCount{}
+	err := s.db.Sql("SELECT topic, COUNT(*) AS total FROM quote " +
+		"GROUP BY topic ORDER BY topic").Find(&counts)
+	if err == nil {
+		var result []byte
+		result, err = json.Marshal(counts)
+		if err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(result)
+			return
+		}
+	}
+	fmt.Println(err)
+	w.WriteHeader(http.StatusInternalServerError)
+}
 
-	if has && err == nil {
+// returnQuote writes out the quote, or the status code matching err
+func returnQuote(w http.ResponseWriter, quote *Quote, err error) {
+	if err == nil {
 		var result []byte
 		result, err = json.Marshal(quote)
 		if err == nil {
 			w.Write(result)
-			w.WriteHeader(http.StatusOK)
 			return
 		}
 	}
-	switch {
-	case err == nil:
+	switch err {
+	case errNoQuotes:
 		w.WriteHeader(http.StatusNotFound)
 	default:
 		fmt.Println(err)
@@ -81,67 +220,361 @@ func (s *QuoteServer) returnQuoteByTopic(w http.ResponseWriter, topic string) {
 	}
 }
 
-// GetRandomQuoteHandler is the handler that looks up what quotes have been
-// seen so far and returns one that hasn't been seen lately
-func (s *QuoteServer) GetRandomQuoteHandler(w http.ResponseWriter, r *http.Request) {
-	key := r.Header.Get("x-auth-token")
-	authed, err := s.Authenticate(key)
+// randomQuote picks a quote from the topic, or from all quotes if the topic
+// is empty, without regard to what the caller has already seen
+func (s *QuoteServer) randomQuote(topic string) (*Quote, error) {
+	// a second attempt is made with freshly loaded IDs in case the
+	// cached ones are stale
+	for i := 0; i < 2; i++ {
+		ids, err := s.ids.get(topic, s.quoteIDs)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			return nil, errNoQuotes
+		}
+
+		quote := &Quote{}
+		has, err := s.db.Id(ids[rand.Intn(len(ids))]).Get(quote)
+		if err != nil {
+			return nil, err
+		}
+		if has {
+			return quote, nil
+		}
+		s.ids.invalidate(topic)
+	}
+	return nil, errNoQuotes
+}
+
+// unseenKey is the Redis key of the set of quote IDs the token hasn't seen
+// yet in the topic. The empty topic covers all quotes. The token is hashed,
+// to keep it out of Redis and apart from other keys.
+func unseenKey(token, topic string) string {
+	key := "unseen:tok:" + authCacheKey(token)
+	if topic != "" {
+		key += ":" + topic
+	}
+	return key
+}
+
+// legacyUnseenKey is the key the token's set of all quotes used to be kept
+// under, which was the token itself, or "" if the token may name one of the
+// server's own keys, all of which have a colon in them. Those sets are only
+// thrown away when the unseen sets are invalidated.
+func legacyUnseenKey(token string) string {
+	if strings.Contains(token, ":") {
+		return ""
+	}
+	return token
+}
+
+// unseenIndexKey is the Redis key of the set of unseen set keys that have
+// been filled from the topic, so they can be found again to invalidate them
+func unseenIndexKey(topic string) string {
+	return "unseen:" + topic
+}
+
+// ping checks Redis can be reached through the pool
+func ping(pool *redis.Pool) error {
+	conn := pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	return err
+}
+
+// nextUnseenQuote draws a quote from the topic that the token hasn't seen
+// since it last went through every quote in it. The quote IDs not yet seen
+// are kept in a Redis set, and SPOP gives us a random one of them.
+func (s *QuoteServer) nextUnseenQuote(token, topic string) (*Quote, error) {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	key := unseenKey(token, topic)
+
+	for i := 0; i < maxUnseenDraws; i++ {
+		id, err := redis.Int64(conn.Do("SPOP", key))
+		switch {
+		case err == redis.ErrNil:
+			id, err = s.refillUnseen(conn, token, topic)
+			if err != nil {
+				return nil, err
+			}
+		case err != nil:
+			return nil, err
+		}
+
+		quote := &Quote{}
+		has, err := s.db.Id(id).Get(quote)
+		if err != nil {
+			return nil, err
+		}
+		// topics are compared as MySQL compares them in quoteIDs
+		if has && (topic == "" || strings.EqualFold(quote.Topic, topic)) {
+			return quote, nil
+		}
+		// the quote was deleted or moved after it went into the set, maybe
+		// behind the server's back, so the cached IDs can't be trusted either
+		s.ids.invalidate(topic)
+	}
+	return nil, errNoQuotes
+}
+
+// refillUnseen starts a new cycle once an unseen set is exhausted. One quote
+// ID, picked at random, is held back to be served straight away, and the rest
+// go back into the set. The set is WATCHed and checked to still be empty, so
+// that if a concurrent request for the same token refills it first, this
+// refill is dropped and a quote is drawn from the other one instead. Neither
+// request then serves the same quote, or puts back quotes already drawn.
+// Filling the set of all quotes drops the one kept under the token itself.
+func (s *QuoteServer) refillUnseen(conn redis.Conn, token, topic string) (int64, error) {
+	key := unseenKey(token, topic)
+	ids, err := s.ids.get(topic, s.quoteIDs)
 	if err != nil {
-		fmt.Println("error authenticating: ", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return 0, err
 	}
-	if !authed {
-		fmt.Println("unauthorized: ", key)
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+	if len(ids) == 0 {
+		return 0, errNoQuotes
+	}
+	i := rand.Intn(len(ids))
+	next := ids[i]
+	rest := make([]int64, 0, len(ids)-1)
+	rest = append(append(rest, ids[:i]...), ids[i+1:]...)
+	if len(rest) == 0 {
+		return next, nil
 	}
 
-	quote := &Quote{}
-	has, err := s.db.OrderBy("RAND()").Get(quote)
-	if has && err == nil {
-		var result []byte
-		result, err = json.Marshal(quote)
-		if err == nil {
-			w.Write(result)
-			w.WriteHeader(http.StatusOK)
-			return
+	args := redis.Args{}.Add(key).AddFlat(rest)
+	for attempt := 0; attempt < maxRefillAttempts; attempt++ {
+		if _, err := conn.Do("WATCH", key); err != nil {
+			return 0, err
+		}
+		n, err := redis.Int(conn.Do("SCARD", key))
+		if err != nil {
+			conn.Do("UNWATCH")
+			return 0, err
+		}
+		if n > 0 {
+			// another request got there first
+			if _, err := conn.Do("UNWATCH"); err != nil {
+				return 0, err
+			}
+			id, err := redis.Int64(conn.Do("SPOP", key))
+			switch err {
+			case nil:
+				return id, nil
+			case redis.ErrNil:
+				continue
+			default:
+				return 0, err
+			}
+		}
+
+		conn.Send("MULTI")
+		conn.Send("SADD", args...)
+		conn.Send("SADD", unseenIndexKey(topic), key)
+		if legacy := legacyUnseenKey(token); topic == "" && legacy != "" {
+			conn.Send("DEL", legacy)
+		}
+		reply, err := conn.Do("EXEC")
+		if err == nil && reply == nil {
+			// a nil reply means the transaction was aborted
+			err = redis.ErrNil
+		}
+		switch err {
+		case nil:
+			return next, nil
+		case redis.ErrNil:
+			continue
+		default:
+			return 0, err
 		}
 	}
-	switch {
-	case err == nil:
-		w.WriteHeader(http.StatusNotFound)
-	default:
-		fmt.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+	return 0, errRefillContention
+}
+
+// quotesChanged must be called by anything that adds or removes quotes in
+// the topic, so that the change is picked up at the next draw
+func (s *QuoteServer) quotesChanged(topic string) error {
+	s.ids.invalidate(topic)
+	s.authorIndex.invalidate()
+	return s.invalidateUnseen(topic)
+}
+
+// invalidateUnseen throws away the unseen sets filled from the topic, and
+// those filled from all quotes, so that a quote added to or removed from the
+// topic is picked up at the next draw instead of at the end of the cycle.
+func (s *QuoteServer) invalidateUnseen(topic string) error {
+	if s.redis == nil {
+		return nil
+	}
+	if !s.redisAvailable() {
+		return errRedisDown
+	}
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	for _, t := range []string{topic, ""} {
+		if _, err := invalidateUnseenScript.Do(conn, unseenIndexKey(t)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// invalidateUnseenScript deletes the unseen sets in an index, and the index,
+// in one go, so that a set filled while they are being deleted is either
+// deleted with them or left in the index to be deleted next time. It returns
+// how many sets were deleted.
+var invalidateUnseenScript = redis.NewScript(1, `
+local keys = redis.call("SMEMBERS", KEYS[1])
+for _, key in ipairs(keys) do
+	redis.call("DEL", key)
+end
+redis.call("DEL", KEYS[1])
+return #keys
+`)
+
+// quoteIDs returns the IDs of every quote in the topic, or of all quotes if
+// the topic is empty, in ascending order
+func (s *QuoteServer) quoteIDs(topic string) ([]int64, error) {
+	session := s.db.Cols("id").Asc("id")
+	if topic != "" {
+		session = session.Where("topic = ?", topic)
+	}
+	var quotes []Quote
+	if err := session.Find(&quotes); err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0, len(quotes))
+	for _, q := range quotes {
+		ids = append(ids, q.ID)
+	}
+	return ids, nil
+}
+
+// Scopes the quote server's routes need
+const (
+	scopeQuotesRead  = "quotes:read"
+	scopeQuotesWrite = "quotes:write"
+)
+
+// Principal is who a request has been authenticated as, and what they may do
+type Principal struct {
+	Token  string
+	ID     int64
+	Scopes []string
+}
+
+// HasScope returns true if the principal has been granted the scope
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
 	}
+	return false
 }
 
-// Authenticate returns true if the request is authenticated, false else
-func (s *QuoteServer) Authenticate(authToken string) (bool, error) {
+// Authenticate returns who the token belongs to, or nil if it isn't valid.
+// Signed tokens are checked here when possible, and otherwise the auth
+// server is asked, and its answer cached for as long as it allows. If the
+// auth server can't be reached the error is an *unavailableError.
+func (s *QuoteServer) Authenticate(authToken string) (*Principal, error) {
 	if authToken == "" {
-		return false, nil
+		return nil, nil
 	}
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/token/%s",
-		s.authaddr, authToken), nil)
-	if err != nil {
-		return false, err
+	if looksSigned(authToken) {
+		principal, err := s.signed.verify(authToken)
+		if err == nil {
+			return principal, nil
+		}
+		fmt.Println("checking signed token with the auth server: ", err)
+	}
+	if principal, ok := s.authCache.get(authToken); ok {
+		return principal, nil
+	}
+	resp, err := s.auth.do(func() (*http.Request, error) {
+		// the token goes in a header rather than the path so it stays out
+		// of the auth server's access logs
+		req, err := http.NewRequest("POST", s.authaddr+"/token/verify", nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("x-auth-token", authToken)
+		return req, nil
+	})
+	if _, unavailable := err.(*unavailableError); unavailable && s.auth.config.FailOpen > 0 {
+		if principal := s.authCache.getStale(authToken, s.auth.config.FailOpen); principal != nil {
+			fmt.Println("using cached principal: ", err)
+			return principal, nil
+		}
 	}
-	resp, err := http.DefaultTransport.RoundTrip(req)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	defer resp.Body.Close()
-	return resp.StatusCode == http.StatusOK, nil
+	age, cacheable := maxAge(resp.Header)
+	if resp.StatusCode != http.StatusOK {
+		// other failures may not be the token's fault, so only a plain
+		// rejection is remembered
+		if cacheable && resp.StatusCode == http.StatusUnauthorized {
+			s.authCache.put(authToken, nil, age)
+		}
+		return nil, nil
+	}
+	principal := &Principal{Token: authToken}
+	if err := json.NewDecoder(resp.Body).Decode(principal); err != nil {
+		return nil, fmt.Errorf("bad response from auth server: %s", err)
+	}
+	if cacheable {
+		s.authCache.put(authToken, principal, age)
+	}
+	return principal, nil
 }
 
-// ServerHandlers returns HTTP handlers for the server
+// ServerHandlers returns HTTP handlers for the server. Quote routes need a
+// token with the scope for what they do.
 func (s *QuoteServer) ServerHandlers() http.Handler {
 	r := mux.NewRouter()
+	r.Methods("GET").Path("/topics").Handler(
+		s.requireScope(scopeQuotesRead, s.GetTopicsHandler))
+	r.Methods("GET").Path("/authors").Handler(
+		s.requireScope(scopeQuotesRead, s.GetAuthorsHandler))
+	r.Methods("GET").Path("/authors/{name}/quotes").Handler(
+		s.requireScope(scopeQuotesRead, s.GetAuthorQuotesHandler))
+	r.Methods("GET").Path("/authors/{name}/random").Handler(
+		s.requireScope(scopeQuotesRead, s.GetAuthorRandomQuoteHandler))
+	r.Methods("POST").Path("/quotes").Handler(
+		s.requireScope(scopeQuotesWrite, s.CreateQuoteHandler))
+	r.Methods("POST").Path("/quotes/import").Handler(
+		s.requireScope(scopeQuotesWrite, s.ImportQuotesHandler))
+	// registered ahead of topics, so "export" and "search" can't be used as one
+	r.Methods("GET").Path("/quotes/export").Handler(
+		s.requireScope(scopeQuotesRead, s.ExportQuotesHandler))
+	r.Methods("GET").Path("/quotes/search").Handler(
+		s.requireScope(scopeQuotesRead, s.SearchQuotesHandler))
+	r.Methods("GET").Path("/quotes/id/{id:[0-9]+}").Handler(
+		s.requireScope(scopeQuotesRead, s.GetQuoteByIDHandler))
+	r.Methods("PUT", "PATCH").Path("/quotes/id/{id:[0-9]+}").Handler(
+		s.requireScope(scopeQuotesWrite, s.UpdateQuoteHandler))
+	r.Methods("DELETE").Path("/quotes/id/{id:[0-9]+}").Handler(
+		s.requireScope(scopeQuotesWrite, s.DeleteQuoteHandler))
+	// topics are words, so a number on its own is taken to be an ID
+	r.Methods("GET").Path("/quotes/{id:[0-9]+}").Handler(
+		s.requireScope(scopeQuotesRead, s.GetQuoteByIDHandler))
 	r.Methods("GET").Path("/quotes/{topic:[a-zA-Z0-9]+}").Handler(
-		http.HandlerFunc(s.GetQuoteHandler))
+		s.requireScope(scopeQuotesRead, s.GetQuoteHandler))
 	r.Methods("GET").Path("/randomquote").Handler(
-		http.HandlerFunc(s.GetRandomQuoteHandler))
+		s.requireScope(scopeQuotesRead, s.GetRandomQuoteHandler))
+	r.Methods("POST").Path("/authcache/purge").Handler(
+		http.HandlerFunc(s.PurgeAuthCacheHandler))
+	r.Methods("GET").Path("/metrics").Handler(
+		http.HandlerFunc(s.MetricsHandler))
+	r.Methods("GET").Path("/healthz").Handler(
+		http.HandlerFunc(s.LiveHandler))
+	r.Methods("GET").Path("/readyz").Handler(
+		http.HandlerFunc(s.ReadyHandler))
 	return r
 }
 
@@ -151,6 +584,9 @@ func setupSQL(dbtype, dbsource string) (*xorm.Engine, error) {
 		return nil, err
 	}
 	err = engine.CreateTables(&Quote{})
+	if err == nil {
+		err = setupSearch(engine, dbtype)
+	}
 	if err != nil {
 		engine.Close()
 		return nil, err
@@ -162,34 +598,123 @@ func main() {
 	var mysqldb = flag.String("db", "", "The DB source")
 	var redisAddr = flag.String("redis", "", "Where Redis is")
 	var authserver = flag.String("auth", "", "Where the auth server is")
+	var redisMaxIdle = flag.Int("redis-max-idle", defaultRedisMaxIdle, "How many idle Redis connections are kept")
+	var redisMaxActive = flag.Int("redis-max-active", defaultRedisMaxActive,
+		"How many Redis connections may be open at once, 0 for no limit")
+	var redisIdleTimeout = flag.Duration("redis-idle-timeout", defaultRedisIdleTimeout,
+		"How long a Redis connection may be idle before it is closed")
+	var authCacheTTL = flag.Duration("auth-cache-ttl", defaultAuthCacheTTL,
+		"How long the auth server's answers are cached, 0 to not cache them")
+	var authCacheNegativeTTL = flag.Duration("auth-cache-negative-ttl", defaultAuthCacheNegativeTTL,
+		"How long rejected tokens are cached")
+	var authCacheSize = flag.Int("auth-cache-size", defaultAuthCacheSize, "How many tokens are cached")
+	var authCacheShared = flag.Bool("auth-cache-shared", false,
+		"Keep the auth cache in Redis, shared with other quote servers")
+	var purgeSecret = flag.String("purge-secret", "",
+		"The secret the auth server sends to purge revoked tokens from the auth cache, "+
+			"which /metrics also needs. Both are refused without one")
+	authClient := DefaultAuthClientConfig()
+	flag.DurationVar(&authClient.ConnectTimeout, "auth-connect-timeout", authClient.ConnectTimeout,
+		"How long connecting to the auth server may take")
+	flag.DurationVar(&authClient.ResponseTimeout, "auth-response-timeout", authClient.ResponseTimeout,
+		"How long the auth server may take to answer")
+	flag.IntVar(&authClient.Retries, "auth-retries", authClient.Retries,
+		"How many times a token check that gets no answer is retried")
+	flag.IntVar(&authClient.BreakerThreshold, "auth-breaker-threshold", authClient.BreakerThreshold,
+		"How many failed token checks in a row stop the auth server being asked, 0 to always ask")
+	flag.DurationVar(&authClient.BreakerCooldown, "auth-breaker-cooldown", authClient.BreakerCooldown,
+		"How long the auth server isn't asked after too many failures")
+	flag.DurationVar(&authClient.FailOpen, "auth-fail-open", 0,
+		"How long past expiry cached tokens are accepted while the auth server is down, 0 to refuse them")
+	var authCA = flag.String("auth-ca", "",
+		"A CA certificate file to check the auth server's certificate against")
+	var authCert = flag.String("auth-cert", "", "A client certificate file to present to the auth server")
+	var authKey = flag.String("auth-key", "", "The key file for -auth-cert")
+	rateLimits := rateLimitFlag{}
+	flag.Var(rateLimits, "rate-limit",
+		"A rate limit for tokens with a scope, as scope=requests/period, such as quotes:read=60/1m. "+
+			"The anonymous scope limits every request by client IP, before its token is checked. May be repeated.")
+	serveConfig := serve.Config{}
+	serveConfig.RegisterFlags(flag.CommandLine, ":8080")
 
-	flag.Parse()
-
-	var engine *xorm.Engine
-	var redisConn redis.Conn
-	var err error
+	settings, err := config.Load(flag.CommandLine, os.Args[1:], config.Options{
+		EnvPrefix: "SERVER",
+		Secret:    []string{"db", "purge-secret"},
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if settings.PrintRequested() {
+		settings.Print(os.Stdout)
+		return
+	}
+	if err := settings.Require("db"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	rand.Seed(time.Now().UnixNano())
 
-	for {
-		if engine == nil {
-			engine, err = setupSQL("mysql", *mysqldb)
-			if err != nil {
-				fmt.Println(err.Error())
-				time.Sleep(5 * time.Second)
-				continue
-			}
+	if flag.NArg() > 0 {
+		err := runCommand(flag.Arg(0), flag.Args()[1:], *mysqldb, *redisAddr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
+		return
+	}
 
-		redisConn, err = redis.Dial("tcp", *redisAddr)
+	if err := settings.Require("auth"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	authClient.TLS, err = authTLSConfig(*authCA, *authCert, *authKey)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	stop := serve.StopOnSignal()
+
+	var engine *xorm.Engine
+	for {
+		engine, err = setupSQL("mysql", *mysqldb)
 		if err == nil {
 			break
 		}
 		fmt.Println(err.Error())
-		time.Sleep(5 * time.Second)
+		select {
+		case <-stop:
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+
+	// quotes can be served without Redis, so the server starts whether or
+	// not it's there and picks it up when it is
+	var redisPool *redis.Pool
+	if *redisAddr != "" {
+		redisPool = newRedisPool(*redisAddr, *redisMaxIdle, *redisMaxActive, *redisIdleTimeout)
 	}
-	defer engine.Close()
-	defer redisConn.Close()
 
-	q := NewQuoteServer(engine, redisConn, *authserver)
-	fmt.Println("Starting server")
-	http.ListenAndServe(":8080", q.ServerHandlers())
+	q := NewQuoteServer(engine, redisPool, *authserver)
+	if redisPool != nil {
+		q.checkRedis()
+		go q.watchRedis(redisCheckInterval)
+	}
+	q.ConfigureAuthClient(authClient)
+	q.ConfigureRateLimits(rateLimits)
+	q.ConfigureAuthCache(*authCacheTTL, *authCacheNegativeTTL, *authCacheSize, *authCacheShared)
+	q.ConfigurePurgeSecret(*purgeSecret)
+	fmt.Println("Starting server on", serveConfig.Addr)
+	err = serve.Serve(q.ServerHandlers(), serveConfig, stop)
+
+	// requests are done with the database and Redis once serve returns
+	if redisPool != nil {
+		redisPool.Close()
+	}
+	engine.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
@@ -1,34 +1,63 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/endophage/quotivational/serve"
 	"github.com/garyburd/redigo/redis"
 	"github.com/rafaeljusto/redigomock"
+	"golang.org/x/crypto/ed25519"
 )
 
+// authServer fakes the auth server. Token 12345 may read and write quotes,
+// while 54321 may only read them.
 func authServer(success bool) *httptest.Server {
+	scopes := map[string]string{
+		"12345": `{"Scopes": ["quotes:read", "quotes:write"]}`,
+		"54321": `{"Scopes": ["quotes:read"]}`,
+	}
 	m := http.NewServeMux()
-	handlerFunc := func(w http.ResponseWriter, r *http.Request) {
-		if success {
-			w.WriteHeader(http.StatusOK)
-		} else {
+	m.Handle("/healthz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	m.Handle("/token/verify", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := scopes[r.Header.Get("x-auth-token")]
+		if !success || !ok {
 			w.WriteHeader(http.StatusUnauthorized)
+			return
 		}
-	}
-
-	m.Handle("/token/12345", http.HandlerFunc(handlerFunc))
-	m.Handle("/token/54321", http.HandlerFunc(handlerFunc))
+		w.Write([]byte(body))
+	}))
 	return httptest.NewServer(m)
 }
 
+// mockPool returns a Redis pool whose connections are all the mock
+func mockPool(c *redigomock.Conn) *redis.Pool {
+	return &redis.Pool{
+		Dial:    func() (redis.Conn, error) { return c, nil },
+		MaxIdle: 1,
+	}
+}
+
 func TestGetQuoteByIDNoAuthToken(t *testing.T) {
 	tempDir, err := ioutil.TempDir("", "quotivational")
 	if err != nil {
@@ -356,7 +385,7 @@ func TestGetRandomQuoteNoQuotes(t *testing.T) {
 	}
 	defer engine.Close()
 
-	key := "12345"
+	key := unseenKey("12345", "")
 
 	c := redigomock.NewConn()
 	c.Command("SADD", key, 0).Expect("ok")
@@ -369,7 +398,7 @@ func TestGetRandomQuoteNoQuotes(t *testing.T) {
 	auth := authServer(true)
 	defer auth.Close()
 
-	q := NewQuoteServer(engine, c, auth.URL)
+	q := NewQuoteServer(engine, mockPool(c), auth.URL)
 	ts := httptest.NewServer(q.ServerHandlers())
 	defer ts.Close()
 
@@ -412,11 +441,13 @@ func TestGetRandomQuoteExistingQuote(t *testing.T) {
 		}
 	}
 
-	key := "12345"
+	key := unseenKey("12345", "")
 
 	c := redigomock.NewConn()
-	c.Command("SADD", key, 1).Expect("ok")
+	c.GenericCommand("SADD").Expect("ok")
+	legacy := c.Command("DEL", "12345").Expect(int64(1))
 	c.Command("WATCH").Expect("ok")
+	c.Command("SCARD", key).Expect(int64(0)).Expect(int64(0)).Expect(int64(0))
 	c.Command("MULTI").Expect("ok")
 	c.Command("EXEC").ExpectError(redis.ErrNil).Expect("ok").Expect("ok")
 	c.Command("DISCARD").Expect("ok")
@@ -425,7 +456,7 @@ func TestGetRandomQuoteExistingQuote(t *testing.T) {
 	auth := authServer(true)
 	defer auth.Close()
 
-	q := NewQuoteServer(engine, c, auth.URL)
+	q := NewQuoteServer(engine, mockPool(c), auth.URL)
 	ts := httptest.NewServer(q.ServerHandlers())
 	defer ts.Close()
 
@@ -458,10 +489,44 @@ func TestGetRandomQuoteExistingQuote(t *testing.T) {
 			t.Fatalf("%v is not what was expected", readQuote)
 		}
 
-		if readQuote.ID != i%2+1 {
+		// refills hold back a quote at random, and the second is drawn
+		if (i == 1 && readQuote.ID != 2) || readQuote.ID < 1 || readQuote.ID > 2 {
 			t.Fatalf("%v is not what was expected", readQuote)
 		}
 	}
+	if c.Stats(legacy) == 0 {
+		t.Fatalf("expected the set kept under the token itself to be dropped")
+	}
+}
+
+func TestRefillUnseenDrawsFromAConcurrentRefill(t *testing.T) {
+	key := unseenKey("12345", "life")
+	c := redigomock.NewConn()
+	c.Command("WATCH", key).Expect("ok")
+	// the set is still empty at the first attempt, which another request's
+	// refill then aborts
+	scard := c.Command("SCARD", key).Expect(int64(0)).Expect(int64(2))
+	c.Command("MULTI").Expect("ok")
+	sadd := c.GenericCommand("SADD").Expect("ok")
+	exec := c.Command("EXEC").Expect(nil)
+	c.Command("UNWATCH").Expect("ok")
+	spop := c.Command("SPOP", key).Expect(int64(3))
+
+	q := NewQuoteServer(nil, mockPool(c), "")
+	q.ids.entries["life"] = idCacheEntry{ids: []int64{1, 2, 3}, expires: time.Now().Add(time.Hour)}
+	id, err := q.refillUnseen(c, "12345", "life")
+	if err != nil {
+		t.Fatalf("expected no error refilling, got %s", err)
+	}
+	if id != 3 {
+		t.Fatalf("expected the quote drawn from the other refill, got %d", id)
+	}
+	if c.Stats(scard) != 2 || c.Stats(exec) != 1 || c.Stats(spop) != 1 {
+		t.Fatalf("expected the refill to be checked again and dropped after it was aborted")
+	}
+	if c.Stats(sadd) != 2 {
+		t.Fatalf("expected the aborted refill not to be retried, got %d SADDs", c.Stats(sadd))
+	}
 }
 
 func TestGetRandomQuoteDiffersByUSerID(t *testing.T) {
@@ -494,13 +559,13 @@ func TestGetRandomQuoteDiffersByUSerID(t *testing.T) {
 	c.Command("MULTI").Expect("ok")
 	c.Command("EXEC").ExpectError(redis.ErrNil).Expect("ok").Expect("ok")
 	c.Command("DISCARD").Expect("ok")
-	c.Command("SPOP", "12345").Expect(int64(2))
-	c.Command("SPOP", "54321").Expect(int64(1))
+	c.Command("SPOP", unseenKey("12345", "")).Expect(int64(2))
+	c.Command("SPOP", unseenKey("54321", "")).Expect(int64(1))
 
 	auth := authServer(true)
 	defer auth.Close()
 
-	q := NewQuoteServer(engine, c, auth.URL)
+	q := NewQuoteServer(engine, mockPool(c), auth.URL)
 	ts := httptest.NewServer(q.ServerHandlers())
 	defer ts.Close()
 
@@ -540,3 +605,1980 @@ func TestGetRandomQuoteDiffersByUSerID(t *testing.T) {
 		}
 	}
 }
+
+func TestGetQuoteByTopicDiffersByTopic(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	engine, err := setupSQL("sqlite3", filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("expected no error setting up SQLite: %s", err)
+	}
+	defer engine.Close()
+
+	for i, topic := range []string{"life", "science", "science"} {
+		_, err = engine.Insert(&Quote{
+			Topic:  topic,
+			Text:   fmt.Sprintf("this is quote %d", i),
+			Author: "iman author",
+		})
+		if err != nil {
+			t.Fatalf("expected no error inserting into SQLite: %s", err)
+		}
+	}
+
+	c := redigomock.NewConn()
+	c.Command("SPOP", unseenKey("12345", "science")).Expect(int64(3))
+	// life only has the one quote, so it's served without a refill
+	c.Command("SPOP", unseenKey("12345", "life")).ExpectError(redis.ErrNil)
+
+	auth := authServer(true)
+	defer auth.Close()
+
+	q := NewQuoteServer(engine, mockPool(c), auth.URL)
+	ts := httptest.NewServer(q.ServerHandlers())
+	defer ts.Close()
+
+	topics := []string{"Science", "life"}
+	expectedIDs := []int64{3, 1}
+
+	for i, topic := range topics {
+		req, err := http.NewRequest("GET", ts.URL+"/quotes/"+topic, nil)
+		req.Header.Add("x-auth-token", "12345")
+		if err != nil {
+			t.Fatalf("expected no error setting up a request: %s", err)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("should not have gotten an error making a request: %s", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected a 200 response, got %v", resp.StatusCode)
+		}
+
+		respJSON, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("could not read response body: %s", err)
+		}
+
+		readQuote := &Quote{}
+		if err := json.Unmarshal(respJSON, readQuote); err != nil {
+			t.Fatalf("could not parse response: %s", err)
+		}
+
+		if readQuote.ID != expectedIDs[i] {
+			t.Fatalf("%v is not what was expected", readQuote)
+		}
+	}
+}
+
+func TestInvalidateUnseenDeletesTopicAndAllQuotesSets(t *testing.T) {
+	c := redigomock.NewConn()
+	topicDel := c.Command("EVALSHA", redigomock.NewAnyData(), 1, "unseen:life").Expect(int64(2))
+	allDel := c.Command("EVALSHA", redigomock.NewAnyData(), 1, "unseen:").Expect(int64(1))
+
+	q := NewQuoteServer(nil, mockPool(c), "")
+	if err := q.invalidateUnseen("life"); err != nil {
+		t.Fatalf("expected no error invalidating unseen sets: %s", err)
+	}
+
+	if c.Stats(topicDel) != 1 || c.Stats(allDel) != 1 {
+		t.Fatalf("expected both the topic and the all quotes sets to be deleted")
+	}
+}
+
+func TestUnseenKeysDontHoldTokens(t *testing.T) {
+	for _, topic := range []string{"", "life"} {
+		key := unseenKey("12345", topic)
+		if strings.Contains(key, "12345") {
+			t.Fatalf("expected the token to be hashed in %q", key)
+		}
+		// a token looking like an index key can't land on one
+		if unseenKey("unseen", topic) == unseenIndexKey(topic) || unseenKey("", "life") == unseenIndexKey("life") {
+			t.Fatalf("expected the unseen set and the index keys to differ")
+		}
+	}
+	if unseenKey("12345", "") == unseenKey("54321", "") {
+		t.Fatalf("expected each token to have its own set")
+	}
+	if legacy := legacyUnseenKey("12345"); legacy != "12345" {
+		t.Fatalf("expected the old set to be keyed by the token, got %q", legacy)
+	}
+	if legacy := legacyUnseenKey("unseen:life"); legacy != "" {
+		t.Fatalf("expected a token naming another key not to be dropped, got %q", legacy)
+	}
+}
+
+func TestGetQuoteByTopicWithoutRedis(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	engine, err := setupSQL("sqlite3", filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("expected no error setting up SQLite: %s", err)
+	}
+	defer engine.Close()
+
+	for i, topic := range []string{"life", "science", "life", "science"} {
+		_, err = engine.Insert(&Quote{
+			Topic:  topic,
+			Text:   fmt.Sprintf("this is quote %d", i),
+			Author: "iman author",
+		})
+		if err != nil {
+			t.Fatalf("expected no error inserting into SQLite: %s", err)
+		}
+	}
+
+	auth := authServer(true)
+	defer auth.Close()
+
+	q := NewQuoteServer(engine, nil, auth.URL)
+	ts := httptest.NewServer(q.ServerHandlers())
+	defer ts.Close()
+
+	for i := 0; i < 10; i++ {
+		req, err := http.NewRequest("GET", ts.URL+"/quotes/science", nil)
+		req.Header.Add("x-auth-token", "12345")
+		if err != nil {
+			t.Fatalf("expected no error setting up a request: %s", err)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("should not have gotten an error making a request: %s", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected a 200 response, got %v", resp.StatusCode)
+		}
+
+		respJSON, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("could not read response body: %s", err)
+		}
+
+		readQuote := &Quote{}
+		if err := json.Unmarshal(respJSON, readQuote); err != nil {
+			t.Fatalf("could not parse response: %s", err)
+		}
+
+		if readQuote.Topic != "science" {
+			t.Fatalf("%v is not what was expected", readQuote)
+		}
+	}
+}
+
+func TestRandomQuoteReloadsStaleIDs(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	engine, err := setupSQL("sqlite3", filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("expected no error setting up SQLite: %s", err)
+	}
+	defer engine.Close()
+
+	first := &Quote{Topic: "life", Text: "this is a quote", Author: "iman author"}
+	if _, err = engine.Insert(first); err != nil {
+		t.Fatalf("expected no error inserting into SQLite: %s", err)
+	}
+
+	q := NewQuoteServer(engine, nil, "")
+	if _, err := q.randomQuote("life"); err != nil {
+		t.Fatalf("expected no error getting a random quote: %s", err)
+	}
+
+	// replace the quote behind the server's back, so its cached IDs are stale
+	if _, err = engine.Id(first.ID).Delete(&Quote{}); err != nil {
+		t.Fatalf("expected no error deleting from SQLite: %s", err)
+	}
+	second := &Quote{Topic: "life", Text: "this is another quote", Author: "iman author"}
+	if _, err = engine.Insert(second); err != nil {
+		t.Fatalf("expected no error inserting into SQLite: %s", err)
+	}
+
+	gotten, err := q.randomQuote("life")
+	if err != nil {
+		t.Fatalf("expected no error getting a random quote: %s", err)
+	}
+	if gotten.ID != second.ID {
+		t.Fatalf("%v is not what was expected", gotten)
+	}
+}
+
+func makeQuoteRequest(t *testing.T, method, url, body string) *http.Response {
+	return makeQuoteRequestAs(t, "12345", method, url, body)
+}
+
+func makeQuoteRequestAs(t *testing.T, token, method, url, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("expected no error setting up a request: %s", err)
+	}
+	req.Header.Add("x-auth-token", token)
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("should not have gotten an error making a request: %s", err)
+	}
+	return resp
+}
+
+func TestCreateQuote(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	engine, err := setupSQL("sqlite3", filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("expected no error setting up SQLite: %s", err)
+	}
+	defer engine.Close()
+
+	auth := authServer(true)
+	defer auth.Close()
+
+	q := NewQuoteServer(engine, nil, auth.URL)
+	ts := httptest.NewServer(q.ServerHandlers())
+	defer ts.Close()
+
+	body := `{"Topic": "Life", "Text": " this is a quote ", "Author": "iman author"}`
+	resp := makeQuoteRequest(t, "POST", ts.URL+"/quotes", body)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected a 201 response, got %v", resp.StatusCode)
+	}
+	if resp.Header.Get("Location") != "/quotes/id/1" {
+		t.Fatalf("unexpected location %s", resp.Header.Get("Location"))
+	}
+
+	gotten := &Quote{}
+	has, err := engine.Id(1).Get(gotten)
+	if err != nil || !has {
+		t.Fatalf("expected the quote to have been stored: %v", err)
+	}
+	if gotten.Topic != "life" || gotten.Text != "this is a quote" {
+		t.Fatalf("%v is not what was expected", gotten)
+	}
+	if gotten.Created.IsZero() || gotten.Updated.IsZero() {
+		t.Fatalf("expected timestamps to be set: %v", gotten)
+	}
+
+	resp = makeQuoteRequest(t, "POST", ts.URL+"/quotes", body)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected a 409 response, got %v", resp.StatusCode)
+	}
+
+	invalid := []string{
+		`{"Topic": "life", "Text": "missing an author"}`,
+		`{"Topic": "not a topic", "Text": "a quote", "Author": "iman author"}`,
+		fmt.Sprintf(`{"Topic": "%s", "Text": "a quote", "Author": "iman author"}`,
+			strings.Repeat("a", maxTopicLength+1)),
+		fmt.Sprintf(`{"Topic": "life", "Text": "%s", "Author": "iman author"}`,
+			strings.Repeat("a", maxTextLength+1)),
+		`{"Topic": "life", "Text": "a quote", "Author": "   "}`,
+		`not json`,
+	}
+	for _, body := range invalid {
+		resp = makeQuoteRequest(t, "POST", ts.URL+"/quotes", body)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected a 400 response for %s, got %v", body, resp.StatusCode)
+		}
+	}
+}
+
+func TestCreateQuoteUnauthorized(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	engine, err := setupSQL("sqlite3", filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("expected no error setting up SQLite: %s", err)
+	}
+	defer engine.Close()
+
+	auth := authServer(false)
+	defer auth.Close()
+
+	q := NewQuoteServer(engine, nil, auth.URL)
+	ts := httptest.NewServer(q.ServerHandlers())
+	defer ts.Close()
+
+	resp := makeQuoteRequest(t, "POST", ts.URL+"/quotes",
+		`{"Topic": "life", "Text": "this is a quote", "Author": "iman author"}`)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected an unauthorized response, got %v", resp.StatusCode)
+	}
+}
+
+func TestReadOnlyTokenCannotWrite(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	engine, err := setupSQL("sqlite3", filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("expected no error setting up SQLite: %s", err)
+	}
+	defer engine.Close()
+	if _, err := engine.Insert(&Quote{Topic: "life", Text: "this is a quote", Author: "iman author"}); err != nil {
+		t.Fatalf("expected no error inserting a quote: %s", err)
+	}
+
+	auth := authServer(true)
+	defer auth.Close()
+
+	q := NewQuoteServer(engine, nil, auth.URL)
+	ts := httptest.NewServer(q.ServerHandlers())
+	defer ts.Close()
+
+	for _, r := range []struct {
+		method, path, body string
+		expected           int
+	}{
+		{"GET", "/quotes/id/1", "", http.StatusOK},
+		{"GET", "/quotes/life", "", http.StatusOK},
+		{"GET", "/randomquote", "", http.StatusOK},
+		{"GET", "/topics", "", http.StatusOK},
+		{"POST", "/quotes", `{"Topic": "life", "Text": "another", "Author": "iman author"}`, http.StatusForbidden},
+		{"PATCH", "/quotes/id/1", `{"Topic": "science"}`, http.StatusForbidden},
+		{"DELETE", "/quotes/id/1", "", http.StatusForbidden},
+		{"POST", "/quotes/import", `{"Topic": "life", "Text": "another", "Author": "iman author"}`, http.StatusForbidden},
+	} {
+		resp := makeQuoteRequestAs(t, "54321", r.method, ts.URL+r.path, r.body)
+		resp.Body.Close()
+		if resp.StatusCode != r.expected {
+			t.Fatalf("expected a %v response to %s %s, got %v", r.expected, r.method, r.path, resp.StatusCode)
+		}
+	}
+
+	quote := &Quote{}
+	if _, err := engine.Id(1).Get(quote); err != nil || quote.Topic != "life" {
+		t.Fatalf("expected the quote to be unchanged, got %v, %v", quote, err)
+	}
+}
+
+func TestUpdateQuote(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	engine, err := setupSQL("sqlite3", filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("expected no error setting up SQLite: %s", err)
+	}
+	defer engine.Close()
+
+	for i := 0; i < 2; i++ {
+		_, err = engine.Insert(&Quote{
+			Topic:  "life",
+			Text:   fmt.Sprintf("this is quote %d", i),
+			Author: "iman author",
+		})
+		if err != nil {
+			t.Fatalf("expected no error inserting into SQLite: %s", err)
+		}
+	}
+
+	auth := authServer(true)
+	defer auth.Close()
+
+	q := NewQuoteServer(engine, nil, auth.URL)
+	ts := httptest.NewServer(q.ServerHandlers())
+	defer ts.Close()
+
+	resp := makeQuoteRequest(t, "PATCH", ts.URL+"/quotes/id/1", `{"Topic": "science"}`)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected a 200 response, got %v", resp.StatusCode)
+	}
+	readQuote := &Quote{}
+	if err := json.NewDecoder(resp.Body).Decode(readQuote); err != nil {
+		t.Fatalf("could not parse response: %s", err)
+	}
+	if readQuote.Topic != "science" || readQuote.Text != "this is quote 0" {
+		t.Fatalf("%v is not what was expected", readQuote)
+	}
+
+	// PUT needs every field
+	resp = makeQuoteRequest(t, "PUT", ts.URL+"/quotes/id/1", `{"Topic": "science"}`)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a 400 response, got %v", resp.StatusCode)
+	}
+
+	// can't be made into a copy of the other quote
+	resp = makeQuoteRequest(t, "PUT", ts.URL+"/quotes/id/1",
+		`{"Topic": "life", "Text": "this is quote 1", "Author": "iman author"}`)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected a 409 response, got %v", resp.StatusCode)
+	}
+
+	resp = makeQuoteRequest(t, "PUT", ts.URL+"/quotes/id/3",
+		`{"Topic": "life", "Text": "this is quote 3", "Author": "iman author"}`)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected a 404 response, got %v", resp.StatusCode)
+	}
+}
+
+func TestDeleteQuote(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	engine, err := setupSQL("sqlite3", filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("expected no error setting up SQLite: %s", err)
+	}
+	defer engine.Close()
+
+	_, err = engine.Insert(&Quote{Topic: "life", Text: "this is a quote", Author: "iman author"})
+	if err != nil {
+		t.Fatalf("expected no error inserting into SQLite: %s", err)
+	}
+
+	auth := authServer(true)
+	defer auth.Close()
+
+	q := NewQuoteServer(engine, nil, auth.URL)
+	ts := httptest.NewServer(q.ServerHandlers())
+	defer ts.Close()
+
+	expected := []int{http.StatusOK, http.StatusNoContent, http.StatusNotFound}
+	methods := []string{"GET", "DELETE", "GET"}
+	for i, method := range methods {
+		resp := makeQuoteRequest(t, method, ts.URL+"/quotes/id/1", "")
+		defer resp.Body.Close()
+		if resp.StatusCode != expected[i] {
+			t.Fatalf("expected a %v response, got %v", expected[i], resp.StatusCode)
+		}
+	}
+
+	resp := makeQuoteRequest(t, "DELETE", ts.URL+"/quotes/id/1", "")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected a 404 response, got %v", resp.StatusCode)
+	}
+}
+
+func TestImportQuotes(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	engine, err := setupSQL("sqlite3", filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("expected no error setting up SQLite: %s", err)
+	}
+	defer engine.Close()
+
+	q := NewQuoteServer(engine, nil, "")
+
+	inputs := []struct {
+		format   string
+		body     string
+		expected importResult
+	}{
+		{
+			format: formatJSONL,
+			body: `{"Topic": "life", "Text": "quote one", "Author": "iman author"}
+
+{"Topic": "life", "Text": "quote one", "Author": "iman author"}
+{"Topic": "life", "Text": "no author"}
+not json
+{"Text": "quote two", "Author": "iman author"}
+`,
+			expected: importResult{Inserted: 2, Skipped: 1, Failed: 2},
+		},
+		{
+			format: formatCSV,
+			body: `Text,Author,Topic
+"quote three, with a comma",iman author,science
+quote one,iman author,life
+`,
+			expected: importResult{Inserted: 1, Skipped: 1},
+		},
+		{
+			format: formatFortune,
+			body: `quote four
+  over two lines
+		-- iman author
+%
+quote five
+%
+%
+`,
+			expected: importResult{Inserted: 2},
+		},
+	}
+	for _, input := range inputs {
+		result, err := q.importQuotes(strings.NewReader(input.body), input.format, "fortunes")
+		if err != nil {
+			t.Fatalf("expected no error importing %s: %s", input.format, err)
+		}
+		if result.Inserted != input.expected.Inserted ||
+			result.Skipped != input.expected.Skipped ||
+			result.Failed != input.expected.Failed {
+			t.Fatalf("unexpected %s import result %v", input.format, result)
+		}
+	}
+
+	if _, err := q.importQuotes(strings.NewReader("quote six\n"), formatFortune, ""); err != errFortuneTopic {
+		t.Fatalf("expected fortunes without a topic to be refused, got %v", err)
+	}
+
+	expected := []Quote{
+		{Topic: "life", Text: "quote one", Author: "iman author"},
+		{Topic: "fortunes", Text: "quote two", Author: "iman author"},
+		{Topic: "science", Text: "quote three, with a comma", Author: "iman author"},
+		{Topic: "fortunes", Text: "quote four\n  over two lines", Author: "iman author"},
+		{Topic: "fortunes", Text: "quote five", Author: fortuneAuthor},
+	}
+	var gotten []Quote
+	if err := engine.Asc("id").Find(&gotten); err != nil {
+		t.Fatalf("expected no error reading from SQLite: %s", err)
+	}
+	if len(gotten) != len(expected) {
+		t.Fatalf("expected %d quotes, got %v", len(expected), gotten)
+	}
+	for i, quote := range gotten {
+		if quote.Topic != expected[i].Topic || quote.Text != expected[i].Text ||
+			quote.Author != expected[i].Author {
+			t.Fatalf("%v is not what was expected", quote)
+		}
+	}
+}
+
+func TestExportQuotesRoundTrips(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// fortune files have no topics, so all of these are in the default one
+	quotes := []Quote{
+		{Topic: "science", Text: "quote one", Author: "iman author"},
+		{Topic: "science", Text: "quote \"two\",\nover two lines", Author: "iman author"},
+	}
+
+	for _, format := range []string{formatJSONL, formatCSV, formatFortune} {
+		engine, err := setupSQL("sqlite3", filepath.Join(tempDir, format))
+		if err != nil {
+			t.Fatalf("expected no error setting up SQLite: %s", err)
+		}
+		defer engine.Close()
+		q := NewQuoteServer(engine, nil, "")
+
+		var buf bytes.Buffer
+		if err := writeQuotes(&buf, format, quotes); err != nil {
+			t.Fatalf("expected no error writing %s: %s", format, err)
+		}
+		result, err := q.importQuotes(&buf, format, "science")
+		if err != nil {
+			t.Fatalf("expected no error importing %s: %s", format, err)
+		}
+		if result.Inserted != len(quotes) {
+			t.Fatalf("unexpected %s import result %v", format, result)
+		}
+
+		buf.Reset()
+		if err := q.exportQuotes(&buf, format, "science"); err != nil {
+			t.Fatalf("expected no error exporting %s: %s", format, err)
+		}
+		var expected bytes.Buffer
+		writeQuotes(&expected, format, quotes)
+		if buf.String() != expected.String() {
+			t.Fatalf("unexpected %s export:\n%s", format, buf.String())
+		}
+	}
+}
+
+func TestImportQuotesHandler(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	engine, err := setupSQL("sqlite3", filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("expected no error setting up SQLite: %s", err)
+	}
+	defer engine.Close()
+
+	auth := authServer(true)
+	defer auth.Close()
+
+	q := NewQuoteServer(engine, nil, auth.URL)
+	ts := httptest.NewServer(q.ServerHandlers())
+	defer ts.Close()
+
+	resp := makeQuoteRequest(t, "POST", ts.URL+"/quotes/import?format=fortune&topic=life",
+		"quote one\n%\nquote two\n\t-- iman author\n")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected a 200 response, got %v", resp.StatusCode)
+	}
+	result := &importResult{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		t.Fatalf("could not parse response: %s", err)
+	}
+	if result.Inserted != 2 {
+		t.Fatalf("unexpected import result %v", result)
+	}
+
+	// blank lines, which are skipped, of exactly the largest size
+	blank := strings.Repeat(strings.Repeat(" ", 1023)+"\n", maxImportSize/1024)
+	for _, bad := range []struct {
+		query    string
+		body     string
+		expected int
+	}{
+		{"format=csv", "quote,by\nquote one,iman author\n", http.StatusBadRequest},
+		{"format=fortune", "quote three\n", http.StatusBadRequest},
+		{"format=jsonl", blank + "\n", http.StatusRequestEntityTooLarge},
+	} {
+		resp := makeQuoteRequest(t, "POST", ts.URL+"/quotes/import?"+bad.query, bad.body)
+		resp.Body.Close()
+		if resp.StatusCode != bad.expected {
+			t.Fatalf("expected a %v response importing with %s, got %v", bad.expected, bad.query, resp.StatusCode)
+		}
+	}
+	// an import of exactly the largest size is fine
+	resp = makeQuoteRequest(t, "POST", ts.URL+"/quotes/import?format=jsonl", blank)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected a 200 response importing %d bytes, got %v", maxImportSize, resp.StatusCode)
+	}
+
+	resp = makeQuoteRequest(t, "GET", ts.URL+"/quotes/export?format=csv", "")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected a 200 response, got %v", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("could not read response body: %s", err)
+	}
+	expected := "topic,author,text\nlife,Anonymous,quote one\nlife,iman author,quote two\n"
+	if string(body) != expected {
+		t.Fatalf("unexpected export:\n%s", body)
+	}
+
+	resp = makeQuoteRequest(t, "GET", ts.URL+"/quotes/export?format=xml", "")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a 400 response, got %v", resp.StatusCode)
+	}
+}
+
+func TestGetTopics(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	engine, err := setupSQL("sqlite3", filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("expected no error setting up SQLite: %s", err)
+	}
+	defer engine.Close()
+
+	auth := authServer(true)
+	defer auth.Close()
+
+	q := NewQuoteServer(engine, nil, auth.URL)
+	ts := httptest.NewServer(q.ServerHandlers())
+	defer ts.Close()
+
+	resp := makeQuoteRequest(t, "GET", ts.URL+"/topics", "")
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("could not read response body: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "[]" {
+		t.Fatalf("expected an empty list of topics, got %v %s", resp.StatusCode, body)
+	}
+
+	for i, topic := range []string{"science", "life", "science"} {
+		_, err = engine.Insert(&Quote{
+			Topic:  topic,
+			Text:   fmt.Sprintf("this is quote %d", i),
+			Author: "iman author",
+		})
+		if err != nil {
+			t.Fatalf("expected no error inserting into SQLite: %s", err)
+		}
+	}
+
+	resp = makeQuoteRequest(t, "GET", ts.URL+"/topics", "")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected a 200 response, got %v", resp.StatusCode)
+	}
+	var counts []topicCount
+	if err := json.NewDecoder(resp.Body).Decode(&counts); err != nil {
+		t.Fatalf("could not parse response: %s", err)
+	}
+	if len(counts) != 2 || counts[0] != (topicCount{"life", 1}) ||
+		counts[1] != (topicCount{"science", 2}) {
+		t.Fatalf("%v is not what was expected", counts)
+	}
+}
+
+func TestSearchQuotes(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	engine, err := setupSQL("sqlite3", filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("expected no error setting up SQLite: %s", err)
+	}
+	defer engine.Close()
+
+	quotes := []Quote{
+		{Topic: "science", Author: "Albert Einstein",
+			Text: "Only two things are infinite, the universe and human stupidity."},
+		{Topic: "drinking", Author: "Sammy Davis Jr.",
+			Text: "Alcohol gives you infinite patience for stupidity."},
+		{Topic: "science", Author: "Albert Einstein",
+			Text: "Infinite infinite infinite."},
+		{Topic: "life", Author: "Sun Tzu",
+			Text: "The supreme art of war is to subdue the enemy without fighting."},
+	}
+	for i := range quotes {
+		if _, err = engine.Insert(&quotes[i]); err != nil {
+			t.Fatalf("expected no error inserting into SQLite: %s", err)
+		}
+	}
+	// changes to the text have to be picked up by the index
+	quotes[3].Text = "Infinite war."
+	if _, err = engine.Id(quotes[3].ID).Cols("text").Update(&quotes[3]); err != nil {
+		t.Fatalf("expected no error updating SQLite: %s", err)
+	}
+	if _, err = engine.Id(quotes[1].ID).Delete(&Quote{}); err != nil {
+		t.Fatalf("expected no error deleting from SQLite: %s", err)
+	}
+
+	auth := authServer(true)
+	defer auth.Close()
+
+	q := NewQuoteServer(engine, nil, auth.URL)
+	ts := httptest.NewServer(q.ServerHandlers())
+	defer ts.Close()
+
+	searches := []struct {
+		query       string
+		expectedIDs []int64
+		total       int
+	}{
+		{"q=INFINITE", []int64{3, 1, 4}, 3},
+		{"q=infinite&limit=1&offset=1", []int64{1}, 3},
+		{"q=infinite&author=einstein", []int64{3, 1}, 2},
+		{"q=infinite&offset=5", []int64{}, 3},
+		{"q=infinite&topic=Life", []int64{4}, 1},
+		{"q=stupidity+war", []int64{1, 4}, 2},
+		{"q=patience", []int64{}, 0},
+	}
+	for _, search := range searches {
+		resp := makeQuoteRequest(t, "GET", ts.URL+"/quotes/search?"+search.query, "")
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected a 200 response for %s, got %v", search.query, resp.StatusCode)
+		}
+		results := &SearchResults{}
+		if err := json.NewDecoder(resp.Body).Decode(results); err != nil {
+			t.Fatalf("could not parse response: %s", err)
+		}
+		if results.Total != search.total || len(results.Results) != len(search.expectedIDs) {
+			t.Fatalf("unexpected results for %s: %v", search.query, results)
+		}
+		for i, result := range results.Results {
+			if result.Quote.ID != search.expectedIDs[i] {
+				t.Fatalf("unexpected results for %s: %v", search.query, results)
+			}
+		}
+	}
+
+	resp := makeQuoteRequest(t, "GET", ts.URL+"/quotes/search?q=human+infinite", "")
+	defer resp.Body.Close()
+	results := &SearchResults{}
+	if err := json.NewDecoder(resp.Body).Decode(results); err != nil {
+		t.Fatalf("could not parse response: %s", err)
+	}
+	for _, result := range results.Results {
+		if result.Quote.ID != 1 {
+			continue
+		}
+		expected := []Highlight{{Start: 20, Length: 8}, {Start: 47, Length: 5}}
+		if len(result.Highlights) != len(expected) ||
+			result.Highlights[0] != expected[0] || result.Highlights[1] != expected[1] {
+			t.Fatalf("unexpected highlights %v", result.Highlights)
+		}
+	}
+
+	for _, query := range []string{"q=", "q=...", "q=infinite&limit=0", "q=infinite&offset=-1"} {
+		resp := makeQuoteRequest(t, "GET", ts.URL+"/quotes/search?"+query, "")
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected a 400 response for %s, got %v", query, resp.StatusCode)
+		}
+	}
+}
+
+func TestAuthors(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	engine, err := setupSQL("sqlite3", filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("expected no error setting up SQLite: %s", err)
+	}
+	defer engine.Close()
+
+	for i, author := range []string{"Albert Einstein", "albert  einstein", "Albert Einstein",
+		"Carl Sagan", "Isaac Asimov"} {
+		_, err = engine.Insert(&Quote{
+			Topic:  "science",
+			Text:   fmt.Sprintf("this is quote %d", i),
+			Author: author,
+		})
+		if err != nil {
+			t.Fatalf("expected no error inserting into SQLite: %s", err)
+		}
+	}
+
+	auth := authServer(true)
+	defer auth.Close()
+
+	q := NewQuoteServer(engine, nil, auth.URL)
+	ts := httptest.NewServer(q.ServerHandlers())
+	defer ts.Close()
+
+	lists := []struct {
+		query    string
+		total    int
+		expected []AuthorCount
+	}{
+		{"", 3, []AuthorCount{{"Albert Einstein", 3}, {"Carl Sagan", 1}, {"Isaac Asimov", 1}}},
+		{"?limit=1&offset=1", 3, []AuthorCount{{"Carl Sagan", 1}}},
+		{"?prefix=ALBERT++EIN", 1, []AuthorCount{{"Albert Einstein", 3}}},
+		{"?prefix=nobody", 0, []AuthorCount{}},
+	}
+	for _, list := range lists {
+		resp := makeQuoteRequest(t, "GET", ts.URL+"/authors"+list.query, "")
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected a 200 response, got %v", resp.StatusCode)
+		}
+		gotten := &AuthorList{}
+		if err := json.NewDecoder(resp.Body).Decode(gotten); err != nil {
+			t.Fatalf("could not parse response: %s", err)
+		}
+		if gotten.Total != list.total || len(gotten.Authors) != len(list.expected) {
+			t.Fatalf("unexpected authors for %q: %v", list.query, gotten)
+		}
+		for i, a := range gotten.Authors {
+			if a != list.expected[i] {
+				t.Fatalf("unexpected authors for %q: %v", list.query, gotten)
+			}
+		}
+	}
+
+	resp := makeQuoteRequest(t, "GET", ts.URL+"/authors/albert%20%20EINSTEIN/quotes?limit=2", "")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected a 200 response, got %v", resp.StatusCode)
+	}
+	quotes := &AuthorQuotes{}
+	if err := json.NewDecoder(resp.Body).Decode(quotes); err != nil {
+		t.Fatalf("could not parse response: %s", err)
+	}
+	if quotes.Author != "Albert Einstein" || quotes.Total != 3 || len(quotes.Quotes) != 2 ||
+		quotes.Quotes[0].ID != 1 || quotes.Quotes[1].ID != 2 {
+		t.Fatalf("unexpected quotes %v", quotes)
+	}
+
+	for i := 0; i < 5; i++ {
+		resp := makeQuoteRequest(t, "GET", ts.URL+"/authors/Carl%20Sagan/random", "")
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected a 200 response, got %v", resp.StatusCode)
+		}
+		readQuote := &Quote{}
+		if err := json.NewDecoder(resp.Body).Decode(readQuote); err != nil {
+			t.Fatalf("could not parse response: %s", err)
+		}
+		if readQuote.ID != 4 {
+			t.Fatalf("%v is not what was expected", readQuote)
+		}
+	}
+
+	for _, path := range []string{"/authors/nobody/random", "/authors/nobody/quotes"} {
+		resp := makeQuoteRequest(t, "GET", ts.URL+path, "")
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected a 404 response for %s, got %v", path, resp.StatusCode)
+		}
+	}
+
+	// authors are cached until the server changes a quote
+	sagan := func(expected int) {
+		resp := makeQuoteRequest(t, "GET", ts.URL+"/authors/carl%20sagan/quotes", "")
+		defer resp.Body.Close()
+		quotes := &AuthorQuotes{}
+		if err := json.NewDecoder(resp.Body).Decode(quotes); err != nil {
+			t.Fatalf("could not parse response: %s", err)
+		}
+		if quotes.Total != expected {
+			t.Fatalf("expected %d quotes by Carl Sagan, got %v", expected, quotes)
+		}
+	}
+	if _, err := engine.Insert(&Quote{Topic: "science", Text: "behind the server's back", Author: "Carl Sagan"}); err != nil {
+		t.Fatalf("expected no error inserting into SQLite: %s", err)
+	}
+	sagan(1)
+	resp = makeQuoteRequest(t, "POST", ts.URL+"/quotes",
+		`{"Topic": "science", "Text": "through the server", "Author": "carl sagan"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected a 201 response, got %v", resp.StatusCode)
+	}
+	sagan(3)
+}
+
+// signTestToken signs claims the way the auth server does
+func signTestToken(t *testing.T, key ed25519.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": "EdDSA", "typ": "JWT", "kid": kid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(signed)))
+}
+
+// signingAuthServer fakes an auth server that publishes the key and lists
+// token "3" as withdrawn, and counts the tokens it is asked to verify
+func signingAuthServer(key ed25519.PrivateKey, verified *int) *httptest.Server {
+	m := http.NewServeMux()
+	m.Handle("/.well-known/jwks.json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		x := base64.RawURLEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+		fmt.Fprintf(w, `{"keys": [{"kty": "OKP", "crv": "Ed25519", "kid": "k1", "x": %q}]}`, x)
+	}))
+	m.Handle("/.well-known/revoked.json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"Withdrawn": [{"ID": "3", "Until": %q}]}`,
+			time.Now().Add(-time.Minute).Format(time.RFC3339))
+	}))
+	m.Handle("/token/verify", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*verified++
+		w.Write([]byte(`{"Scopes": ["quotes:read"]}`))
+	}))
+	return httptest.NewServer(m)
+}
+
+func TestSignedTokensCheckedLocally(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	engine, err := setupSQL("sqlite3", filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("expected no error setting up SQLite: %s", err)
+	}
+	defer engine.Close()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified := 0
+	auth := signingAuthServer(key, &verified)
+	defer auth.Close()
+
+	q := NewQuoteServer(engine, nil, auth.URL)
+	ts := httptest.NewServer(q.ServerHandlers())
+	defer ts.Close()
+
+	hour := time.Now().Add(time.Hour).Unix()
+	for _, c := range []struct {
+		name     string
+		token    string
+		expected int
+	}{
+		{"valid", signTestToken(t, key, "k1", map[string]interface{}{
+			"jti": "1", "scope": "quotes:read", "exp": hour}), http.StatusOK},
+		{"expired", signTestToken(t, key, "k1", map[string]interface{}{
+			"jti": "2", "scope": "quotes:read", "exp": time.Now().Add(-time.Hour).Unix()}), http.StatusUnauthorized},
+		{"withdrawn", signTestToken(t, key, "k1", map[string]interface{}{
+			"jti": "3", "scope": "quotes:read", "exp": hour}), http.StatusUnauthorized},
+		{"not yet valid", signTestToken(t, key, "k1", map[string]interface{}{
+			"jti": "4", "scope": "quotes:read", "nbf": hour, "exp": hour + 60}), http.StatusUnauthorized},
+		{"forged", signTestToken(t, otherKey, "k1", map[string]interface{}{
+			"jti": "5", "scope": "quotes:read", "exp": hour}), http.StatusUnauthorized},
+		{"without scope", signTestToken(t, key, "k1", map[string]interface{}{
+			"jti": "6", "scope": "quotes:write", "exp": hour}), http.StatusForbidden},
+	} {
+		resp := makeQuoteRequestAs(t, c.token, "GET", ts.URL+"/topics", "")
+		resp.Body.Close()
+		if resp.StatusCode != c.expected {
+			t.Fatalf("expected a %v response for the %s token, got %v", c.expected, c.name, resp.StatusCode)
+		}
+	}
+	if verified != 0 {
+		t.Fatalf("expected signed tokens to be checked without the auth server, it was asked %d times", verified)
+	}
+
+	// a token signed with a key the auth server doesn't publish is left to
+	// the auth server to decide on
+	resp := makeQuoteRequestAs(t, signTestToken(t, otherKey, "k2", map[string]interface{}{
+		"jti": "7", "scope": "quotes:read", "exp": hour}), "GET", ts.URL+"/topics", "")
+	resp.Body.Close()
+	if verified != 1 {
+		t.Fatalf("expected the auth server to be asked about an unknown key, it was asked %d times", verified)
+	}
+}
+
+// countingAuthServer is an auth server that counts how often it is asked to
+// verify a token, and sends cacheControl with its answers
+func countingAuthServer(cacheControl string, verified *int) *httptest.Server {
+	m := http.NewServeMux()
+	m.Handle("/token/verify", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*verified++
+		if cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		switch r.Header.Get("x-auth-token") {
+		case "12345":
+			w.Write([]byte(`{"ID": 1, "Scopes": ["quotes:read"]}`))
+		case "67890":
+			w.Write([]byte(`{"ID": 2, "Scopes": ["quotes:read"]}`))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	return httptest.NewServer(m)
+}
+
+func TestAuthResultsCached(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	engine, err := setupSQL("sqlite3", filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("expected no error setting up SQLite: %s", err)
+	}
+	defer engine.Close()
+
+	verified := 0
+	auth := countingAuthServer("private, max-age=60", &verified)
+	defer auth.Close()
+
+	q := NewQuoteServer(engine, nil, auth.URL)
+	ts := httptest.NewServer(q.ServerHandlers())
+	defer ts.Close()
+
+	expectRequest := func(token string, expected, expectedVerified int) {
+		resp := makeQuoteRequestAs(t, token, "GET", ts.URL+"/topics", "")
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Fatalf("expected a %v response for %s, got %v", expected, token, resp.StatusCode)
+		}
+		if verified != expectedVerified {
+			t.Fatalf("expected the auth server to have been asked %d times, it was asked %d times",
+				expectedVerified, verified)
+		}
+	}
+	expectRequest("12345", http.StatusOK, 1)
+	expectRequest("12345", http.StatusOK, 1)
+	expectRequest("67890", http.StatusOK, 2)
+	expectRequest("nope", http.StatusUnauthorized, 3)
+	expectRequest("nope", http.StatusUnauthorized, 3)
+
+	purge := func(secret string, expected int) {
+		req, err := http.NewRequest("POST", ts.URL+"/authcache/purge", strings.NewReader(`{"ID": 1}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secret != "" {
+			req.Header.Set(purgeSecretHeader, secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("expected no error purging the cache: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Fatalf("expected a %v response purging the cache with %q, got %v", expected, secret, resp.StatusCode)
+		}
+	}
+	// purging is refused until the server has a secret, and then needs it
+	purge("", http.StatusForbidden)
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("expected no error getting metrics: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a 403 response getting metrics without a secret, got %v", resp.StatusCode)
+	}
+	q.ConfigurePurgeSecret("sshh")
+	purge("", http.StatusUnauthorized)
+	purge("nope", http.StatusUnauthorized)
+	expectRequest("12345", http.StatusOK, 3)
+
+	// purging a token only drops that token
+	purge("sshh", http.StatusNoContent)
+	expectRequest("12345", http.StatusOK, 4)
+	expectRequest("67890", http.StatusOK, 4)
+
+	getMetrics := func(secret string) *http.Response {
+		req, err := http.NewRequest("GET", ts.URL+"/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secret != "" {
+			req.Header.Set(purgeSecretHeader, secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("expected no error getting metrics: %s", err)
+		}
+		return resp
+	}
+	// metrics need the purge secret too
+	for _, secret := range []string{"", "nope"} {
+		resp := getMetrics(secret)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected a 401 response getting metrics with %q, got %v", secret, resp.StatusCode)
+		}
+	}
+	resp = getMetrics("sshh")
+	defer resp.Body.Close()
+	metrics := &serverMetrics{}
+	if err := json.NewDecoder(resp.Body).Decode(metrics); err != nil {
+		t.Fatalf("expected no error decoding metrics: %s", err)
+	}
+	stats := metrics.AuthCache
+	if stats.Hits != 4 || stats.Misses != 4 || stats.Purges != 1 || stats.Entries != 3 {
+		t.Fatalf("expected 4 hits, 4 misses, 1 purge and 3 entries, got %+v", stats)
+	}
+	if stats.HitRate != 0.5 {
+		t.Fatalf("expected a hit rate of 4/8, got %v", stats.HitRate)
+	}
+}
+
+func TestAuthResultsNotCachedWhenAuthServerSaysNo(t *testing.T) {
+	verified := 0
+	auth := countingAuthServer("no-cache", &verified)
+	defer auth.Close()
+
+	q := NewQuoteServer(nil, nil, auth.URL)
+	for i := 1; i <= 2; i++ {
+		principal, err := q.Authenticate("12345")
+		if err != nil || principal == nil || principal.ID != 1 {
+			t.Fatalf("expected the token to be valid, got %v, %v", principal, err)
+		}
+		if verified != i {
+			t.Fatalf("expected the auth server to be asked every time, it was asked %d times", verified)
+		}
+	}
+}
+
+func TestAuthCacheBounded(t *testing.T) {
+	c := newAuthCache(time.Minute, time.Second, 2, nil)
+	for i, token := range []string{"a", "b", "c"} {
+		c.put(token, &Principal{ID: int64(i + 1)}, -1)
+	}
+	if n := c.stats().Entries; n != 2 {
+		t.Fatalf("expected the cache to hold 2 entries, got %d", n)
+	}
+	if _, ok := c.get("c"); !ok {
+		t.Fatalf("expected the newest entry to be cached")
+	}
+
+	// max-age from the auth server shortens how long an entry is kept
+	c.put("d", &Principal{ID: 4}, 0)
+	if _, ok := c.get("d"); ok {
+		t.Fatalf("expected an entry with no max age not to be cached")
+	}
+}
+
+func TestBearerTokens(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	engine, err := setupSQL("sqlite3", filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("expected no error setting up SQLite: %s", err)
+	}
+	defer engine.Close()
+
+	auth := authServer(true)
+	defer auth.Close()
+
+	q := NewQuoteServer(engine, nil, auth.URL)
+	ts := httptest.NewServer(q.ServerHandlers())
+	defer ts.Close()
+
+	for _, c := range []struct {
+		header   string
+		expected int
+	}{
+		{"Bearer 12345", http.StatusOK},
+		{"bearer 12345", http.StatusOK},
+		{"Bearer 99999", http.StatusUnauthorized},
+		{"Basic 12345", http.StatusUnauthorized},
+		{"Bearer", http.StatusUnauthorized},
+	} {
+		req, err := http.NewRequest("GET", ts.URL+"/topics", nil)
+		if err != nil {
+			t.Fatalf("expected no error setting up a request: %s", err)
+		}
+		req.Header.Set("Authorization", c.header)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("expected no error making a request: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.expected {
+			t.Fatalf("expected a %v response for %q, got %v", c.expected, c.header, resp.StatusCode)
+		}
+	}
+}
+
+func TestRequireScopeSetsPrincipal(t *testing.T) {
+	auth := authServer(true)
+	defer auth.Close()
+
+	q := NewQuoteServer(nil, nil, auth.URL)
+	var principal *Principal
+	handler := q.requireScope(scopeQuotesRead, func(w http.ResponseWriter, r *http.Request) {
+		principal = principalFrom(r)
+	})
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("expected no error setting up a request: %s", err)
+	}
+	req.Header.Set("x-auth-token", "54321")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if principal == nil || principal.Token != "54321" || !principal.HasScope(scopeQuotesRead) {
+		t.Fatalf("expected the handler to be given the caller, got %+v", principal)
+	}
+}
+
+// testAuthClientConfig is an auth client configuration that doesn't keep
+// tests waiting
+func testAuthClientConfig() AuthClientConfig {
+	config := DefaultAuthClientConfig()
+	config.ResponseTimeout = 100 * time.Millisecond
+	config.RetryBackoff = time.Millisecond
+	return config
+}
+
+// flakyAuthServer is an auth server that answers with the statuses in turn,
+// then goes on answering with the last one, counting how often it is asked.
+// Token 12345 is valid when it answers with a 200.
+func flakyAuthServer(attempts *int, statuses ...int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := statuses[len(statuses)-1]
+		if *attempts < len(statuses) {
+			status = statuses[*attempts]
+		}
+		*attempts++
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			w.Write([]byte(`{"ID": 1, "Scopes": ["quotes:read"]}`))
+		}
+	}))
+}
+
+func TestAuthClientRetries(t *testing.T) {
+	attempts := 0
+	auth := flakyAuthServer(&attempts, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK)
+	defer auth.Close()
+
+	q := NewQuoteServer(nil, nil, auth.URL)
+	q.ConfigureAuthClient(testAuthClientConfig())
+	principal, err := q.Authenticate("12345")
+	if err != nil || principal == nil {
+		t.Fatalf("expected the token to be valid after retrying, got %v, %v", principal, err)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected the auth server to be asked 3 times, it was asked %d times", attempts)
+	}
+}
+
+func TestAuthClientTimesOut(t *testing.T) {
+	done := make(chan struct{})
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer auth.Close()
+	defer close(done)
+
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	engine, err := setupSQL("sqlite3", filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("expected no error setting up SQLite: %s", err)
+	}
+	defer engine.Close()
+
+	q := NewQuoteServer(engine, nil, auth.URL)
+	config := testAuthClientConfig()
+	config.Retries = 0
+	q.ConfigureAuthClient(config)
+	ts := httptest.NewServer(q.ServerHandlers())
+	defer ts.Close()
+
+	resp := makeQuoteRequest(t, "GET", ts.URL+"/topics", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected a 503 response when the auth server hangs, got %v", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected a Retry-After header")
+	}
+}
+
+func TestAuthClientCircuitBreaker(t *testing.T) {
+	attempts := 0
+	auth := flakyAuthServer(&attempts, http.StatusInternalServerError)
+	defer auth.Close()
+
+	q := NewQuoteServer(nil, nil, auth.URL)
+	config := testAuthClientConfig()
+	config.Retries = 0
+	config.BreakerThreshold = 2
+	config.BreakerCooldown = time.Minute
+	q.ConfigureAuthClient(config)
+
+	for i := 0; i < 3; i++ {
+		_, err := q.Authenticate("12345")
+		if _, ok := err.(*unavailableError); !ok {
+			t.Fatalf("expected the auth server to be unavailable, got %v", err)
+		}
+	}
+	if attempts != 2 {
+		t.Fatalf("expected the auth server not to be asked once the breaker opened, it was asked %d times", attempts)
+	}
+}
+
+func TestAuthClientFailOpen(t *testing.T) {
+	attempts := 0
+	auth := flakyAuthServer(&attempts, http.StatusOK, http.StatusInternalServerError)
+	defer auth.Close()
+
+	q := NewQuoteServer(nil, nil, auth.URL)
+	config := testAuthClientConfig()
+	config.Retries = 0
+	config.FailOpen = time.Minute
+	q.ConfigureAuthClient(config)
+	q.ConfigureAuthCache(time.Millisecond, time.Millisecond, 10, false)
+
+	if principal, err := q.Authenticate("12345"); err != nil || principal == nil {
+		t.Fatalf("expected the token to be valid, got %v, %v", principal, err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	principal, err := q.Authenticate("12345")
+	if err != nil || principal == nil || principal.ID != 1 {
+		t.Fatalf("expected the cached principal to be used, got %v, %v", principal, err)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected the auth server to be asked again, it was asked %d times", attempts)
+	}
+	if _, err := q.Authenticate("99999"); err == nil {
+		t.Fatalf("expected an uncached token to fail while the auth server is down")
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	engine, err := setupSQL("sqlite3", filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("expected no error setting up SQLite: %s", err)
+	}
+	defer engine.Close()
+
+	auth := authServer(true)
+	defer auth.Close()
+
+	conn := redigomock.NewConn()
+	q := NewQuoteServer(engine, mockPool(conn), auth.URL)
+	limits := rateLimitFlag{}
+	for _, limit := range []string{"quotes:read=60/1m", "anonymous=1/1m"} {
+		if err := limits.Set(limit); err != nil {
+			t.Fatalf("expected no error parsing %s: %s", limit, err)
+		}
+	}
+	q.ConfigureRateLimits(limits)
+	ts := httptest.NewServer(q.ServerHandlers())
+	defer ts.Close()
+
+	bucket := func(key string, rate float64, burst int, reply ...int64) {
+		values := []interface{}{}
+		for _, v := range reply {
+			values = append(values, v)
+		}
+		conn.Command("EVALSHA", redigomock.NewAnyData(), 1, rateLimitKeyPrefix+key,
+			rate, burst, redigomock.NewAnyInt()).Expect(values)
+	}
+	tokenBucket := func(reply ...int64) {
+		bucket("token:"+authCacheKey("12345"), 0.001, 60, reply...)
+	}
+	ipBucket := func(reply ...int64) {
+		bucket("ip:127.0.0.1", 1.0/60000, 1, reply...)
+	}
+
+	// every request is limited by IP first, and then by its token
+	ipBucket(1, 0, 0, 60000)
+	tokenBucket(1, 59, 0, 1000)
+	resp := makeQuoteRequest(t, "GET", ts.URL+"/topics", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected a 200 response under the limit, got %v", resp.StatusCode)
+	}
+	for header, expected := range map[string]string{
+		"X-RateLimit-Limit":     "60",
+		"X-RateLimit-Remaining": "59",
+		"X-RateLimit-Reset":     "1",
+	} {
+		if v := resp.Header.Get(header); v != expected {
+			t.Fatalf("expected %s to be %s, got %q", header, expected, v)
+		}
+	}
+
+	tokenBucket(0, 0, 1500, 60000)
+	resp = makeQuoteRequest(t, "GET", ts.URL+"/topics", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected a 429 response over the limit, got %v", resp.StatusCode)
+	}
+	if v := resp.Header.Get("Retry-After"); v != "2" {
+		t.Fatalf("expected to be told to retry after 2 seconds, got %q", v)
+	}
+
+	// requests over the IP limit are turned away before their token is checked
+	ipBucket(0, 0, 60000, 60000)
+	misses := q.authCache.stats().Misses
+	resp = makeQuoteRequestAs(t, "99999", "GET", ts.URL+"/topics", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected a 429 response for a request over the IP limit, got %v", resp.StatusCode)
+	}
+	if q.authCache.stats().Misses != misses {
+		t.Fatalf("expected the token of a request over the IP limit not to be checked")
+	}
+	ipBucket(1, 0, 0, 60000)
+
+	// limits are dropped rather than taking the server down with Redis
+	conn.Command("EVALSHA", redigomock.NewAnyData(), 1, rateLimitKeyPrefix+"token:"+authCacheKey("12345"),
+		0.001, 60, redigomock.NewAnyInt()).ExpectError(fmt.Errorf("connection refused"))
+	resp = makeQuoteRequest(t, "GET", ts.URL+"/topics", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected a 200 response when Redis fails, got %v", resp.StatusCode)
+	}
+}
+
+func TestRateLimitFlag(t *testing.T) {
+	limits := rateLimitFlag{}
+	if err := limits.Set("quotes:write=10/1s"); err != nil {
+		t.Fatalf("expected no error parsing a limit: %s", err)
+	}
+	if limit := limits["quotes:write"]; limit.Requests != 10 || limit.Period != time.Second {
+		t.Fatalf("expected 10 requests a second, got %v", limit)
+	}
+	for _, bad := range []string{"quotes:write", "=10/1s", "quotes:write=10", "quotes:write=0/1s", "quotes:write=10/forever"} {
+		if err := limits.Set(bad); err == nil {
+			t.Fatalf("expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestRedisPoolChecksIdleConnections(t *testing.T) {
+	pool := newRedisPool("localhost:6379", 1, 1, 0)
+	c := redigomock.NewConn()
+	ping := c.Command("PING").ExpectError(fmt.Errorf("connection reset"))
+
+	if err := pool.TestOnBorrow(c, time.Now()); err != nil || c.Stats(ping) != 0 {
+		t.Fatalf("expected a connection just used not to be checked")
+	}
+	if err := pool.TestOnBorrow(c, time.Now().Add(-time.Minute)); err == nil {
+		t.Fatalf("expected a broken idle connection to fail its check")
+	}
+}
+
+func TestRedisPoolReconnects(t *testing.T) {
+	dialed := 0
+	broken := redigomock.NewConn()
+	broken.ErrMock = func() error { return fmt.Errorf("connection reset") }
+	broken.GenericCommand("EVALSHA").ExpectError(fmt.Errorf("connection reset"))
+	working := redigomock.NewConn()
+	working.GenericCommand("EVALSHA").Expect(int64(0)).Expect(int64(0))
+
+	q := NewQuoteServer(nil, &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			dialed++
+			if dialed == 1 {
+				return broken, nil
+			}
+			return working, nil
+		},
+		MaxIdle: 1,
+	}, "")
+	if err := q.invalidateUnseen("life"); err == nil {
+		t.Fatalf("expected an error from the broken connection")
+	}
+	if err := q.invalidateUnseen("life"); err != nil {
+		t.Fatalf("expected a new connection to be made, got %s", err)
+	}
+	if dialed != 2 {
+		t.Fatalf("expected Redis to be dialed twice, it was dialed %d times", dialed)
+	}
+}
+
+func TestQuotesServedWhileRedisIsDown(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	engine, err := setupSQL("sqlite3", filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("expected no error setting up SQLite: %s", err)
+	}
+	defer engine.Close()
+	if _, err := engine.Insert(&Quote{Topic: "life", Text: "this is a quote", Author: "iman author"}); err != nil {
+		t.Fatalf("expected no error inserting into SQLite: %s", err)
+	}
+
+	auth := authServer(true)
+	defer auth.Close()
+
+	c := redigomock.NewConn()
+	down := fmt.Errorf("connection refused")
+	spop := c.Command("SPOP", unseenKey("12345", "")).ExpectError(down)
+	c.Command("PING").Expect("PONG")
+	q := NewQuoteServer(engine, mockPool(c), auth.URL)
+	ts := httptest.NewServer(q.ServerHandlers())
+	defer ts.Close()
+
+	readiness := func() *healthReport {
+		return checkHealth(t, ts.URL+"/readyz", http.StatusOK)
+	}
+	if report := readiness(); report.Status != statusOK {
+		t.Fatalf("expected the server to start out ok, got %+v", report)
+	}
+	c.Command("PING").ExpectError(down).ExpectError(down)
+
+	// the first request finds Redis has gone and picks a quote at random,
+	// and later ones don't try Redis at all
+	for i := 0; i < 2; i++ {
+		resp := makeQuoteRequest(t, "GET", ts.URL+"/randomquote", "")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected a 200 response without Redis, got %v", resp.StatusCode)
+		}
+	}
+	if c.Stats(spop) != 1 {
+		t.Fatalf("expected Redis to be tried once, it was tried %d times", c.Stats(spop))
+	}
+
+	report := readiness()
+	redisHealth := report.Dependencies["redis"]
+	if report.Status != statusDegraded || redisHealth == nil || redisHealth.Status != statusDown ||
+		redisHealth.Error == "" {
+		t.Fatalf("expected the server to report Redis down, got %+v", report)
+	}
+
+	// once Redis answers again it's used again
+	c.Command("PING").Expect("PONG")
+	if report := readiness(); report.Status != statusOK {
+		t.Fatalf("expected the server to be ok again, got %+v", report)
+	}
+}
+
+// checkHealth gets the health endpoint, checking the response status
+func checkHealth(t *testing.T, url string, expected int) *healthReport {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("expected no error checking health: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expected {
+		t.Fatalf("expected a %v response checking health, got %v", expected, resp.StatusCode)
+	}
+	report := &healthReport{}
+	if err := json.NewDecoder(resp.Body).Decode(report); err != nil {
+		t.Fatalf("expected no error decoding health: %s", err)
+	}
+	return report
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	engine, err := setupSQL("sqlite3", filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("expected no error setting up SQLite: %s", err)
+	}
+	defer engine.Close()
+
+	auth := authServer(true)
+	q := NewQuoteServer(engine, nil, auth.URL)
+	ts := httptest.NewServer(q.ServerHandlers())
+	defer ts.Close()
+
+	if report := checkHealth(t, ts.URL+"/healthz", http.StatusOK); report.Status != statusOK {
+		t.Fatalf("expected the server to be alive, got %+v", report)
+	}
+	report := checkHealth(t, ts.URL+"/readyz", http.StatusOK)
+	if report.Status != statusOK {
+		t.Fatalf("expected the server to be ready, got %+v", report)
+	}
+	for name, expected := range map[string]string{
+		"database": statusOK,
+		"auth":     statusOK,
+		"redis":    statusDisabled,
+	} {
+		if dep := report.Dependencies[name]; dep == nil || dep.Status != expected {
+			t.Fatalf("expected %s to be %s, got %+v", name, expected, dep)
+		}
+	}
+
+	// without the auth server no quotes can be served
+	auth.Close()
+	report = checkHealth(t, ts.URL+"/readyz", http.StatusServiceUnavailable)
+	if dep := report.Dependencies["auth"]; report.Status != statusDown || dep.Status != statusDown || dep.Error == "" {
+		t.Fatalf("expected the auth server to be down, got %+v", report)
+	}
+	if report := checkHealth(t, ts.URL+"/healthz", http.StatusOK); report.Status != statusOK {
+		t.Fatalf("expected the server to still be alive, got %+v", report)
+	}
+}
+
+// writeCert creates a certificate for 127.0.0.1, signed by the parent if
+// there is one, and writes it and its key to PEM files in dir
+func writeCert(t *testing.T, dir, name string, isCA bool, parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestMutualTLSToAuthServer(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	ca, caKey := writeCert(t, tempDir, "ca", true, nil, nil)
+	writeCert(t, tempDir, "auth", false, ca, caKey)
+	writeCert(t, tempDir, "server", false, ca, caKey)
+	path := func(name string) string { return filepath.Join(tempDir, name) }
+
+	auth := authServer(true)
+	auth.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected no error listening: %s", err)
+	}
+	config := serve.Config{TLSCert: path("auth.crt"), TLSKey: path("auth.key"), ClientCA: path("ca.crt")}
+	tlsConfig, err := config.TLSConfig()
+	if err != nil {
+		t.Fatalf("expected no error loading the auth server's TLS config: %s", err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go serve.OnListener(listener, auth.Config.Handler, config, tlsConfig, stop)
+	authURL := "https://" + listener.Addr().String()
+
+	for _, c := range []struct {
+		name      string
+		cert, key string
+		valid     bool
+	}{
+		{"with a client certificate", path("server.crt"), path("server.key"), true},
+		{"without a client certificate", "", "", false},
+	} {
+		clientTLS, err := authTLSConfig(path("ca.crt"), c.cert, c.key)
+		if err != nil {
+			t.Fatalf("expected no error loading the client TLS config: %s", err)
+		}
+		q := NewQuoteServer(nil, nil, authURL)
+		clientConfig := testAuthClientConfig()
+		clientConfig.Retries = 0
+		clientConfig.TLS = clientTLS
+		q.ConfigureAuthClient(clientConfig)
+		principal, err := q.Authenticate("12345")
+		if c.valid && (err != nil || principal == nil) {
+			t.Fatalf("expected the token to be checked %s, got %v, %v", c.name, principal, err)
+		}
+		if !c.valid && err == nil {
+			t.Fatalf("expected the auth server to refuse a connection %s", c.name)
+		}
+	}
+}
+
+func TestUnseenQuotesSkipStaleIDs(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	engine, err := setupSQL("sqlite3", filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("expected no error setting up SQLite: %s", err)
+	}
+	defer engine.Close()
+
+	moved := &Quote{Topic: "science", Text: "moved out of life", Author: "someone"}
+	if _, err := engine.Insert(moved); err != nil {
+		t.Fatalf("expected no error inserting into SQLite: %s", err)
+	}
+
+	c := redigomock.NewConn()
+	c.Command("SPOP", unseenKey("12345", "life")).ExpectError(redis.ErrNil)
+	q := NewQuoteServer(engine, mockPool(c), "")
+
+	// IDs cached before the quote was deleted, or moved to another topic,
+	// behind the server's back
+	for _, stale := range []int64{99, moved.ID} {
+		q.ids.entries["life"] = idCacheEntry{ids: []int64{stale}, expires: time.Now().Add(time.Hour)}
+		done := make(chan error, 1)
+		go func() {
+			_, err := q.nextUnseenQuote("12345", "life")
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != errNoQuotes {
+				t.Fatalf("expected no quotes once the stale ID %d was dropped, got %v", stale, err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expected the stale ID %d not to be drawn over and over", stale)
+		}
+	}
+
+	life := &Quote{Topic: "life", Text: "still here", Author: "someone"}
+	if _, err := engine.Insert(life); err != nil {
+		t.Fatalf("expected no error inserting into SQLite: %s", err)
+	}
+	q.ids.entries["life"] = idCacheEntry{ids: []int64{99}, expires: time.Now().Add(time.Hour)}
+	quote, err := q.nextUnseenQuote("12345", "life")
+	if err != nil || quote.ID != life.ID {
+		t.Fatalf("expected the quote still in the topic once the IDs were reloaded, got %v, %v", quote, err)
+	}
+}
+
+func TestUnseenQuotesInMixedCaseTopics(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "quotivational")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+	engine, err := setupSQL("sqlite3", filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("expected no error setting up SQLite: %s", err)
+	}
+	defer engine.Close()
+
+	life := &Quote{Topic: "Life", Text: "filed under Life", Author: "someone"}
+	if _, err := engine.Insert(life); err != nil {
+		t.Fatalf("expected no error inserting into SQLite: %s", err)
+	}
+
+	c := redigomock.NewConn()
+	c.Command("SPOP", unseenKey("12345", "life")).ExpectError(redis.ErrNil)
+	q := NewQuoteServer(engine, mockPool(c), "")
+	// MySQL finds the quote for "life", which SQLite doesn't
+	q.ids.entries["life"] = idCacheEntry{ids: []int64{life.ID}, expires: time.Now().Add(time.Hour)}
+
+	quote, err := q.nextUnseenQuote("12345", "life")
+	if err != nil || quote.ID != life.ID {
+		t.Fatalf("expected the quote in Life to be served for life, got %v, %v", quote, err)
+	}
+}
+
+func TestSignedTokensDontWaitOnTheAuthServer(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lock sync.Mutex
+	fetches := 0
+	var block chan struct{}
+	failing := false
+	m := http.NewServeMux()
+	m.Handle("/.well-known/jwks.json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		x := base64.RawURLEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+		fmt.Fprintf(w, `{"keys": [{"kty": "OKP", "crv": "Ed25519", "kid": "k1", "x": %q}]}`, x)
+	}))
+	m.Handle("/.well-known/revoked.json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		fetches++
+		wait, fail := block, failing
+		lock.Unlock()
+		if wait != nil {
+			<-wait
+		}
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"Withdrawn": []}`))
+	}))
+	auth := httptest.NewServer(m)
+	defer auth.Close()
+
+	v := newSignedTokens(auth.URL, http.DefaultClient)
+	token := signTestToken(t, key, "k1", map[string]interface{}{
+		"jti": "1", "scope": "quotes:read", "exp": time.Now().Add(time.Hour).Unix()})
+	if principal, err := v.verify(token); err != nil || principal == nil {
+		t.Fatalf("expected the token to be valid, got %v, %v", principal, err)
+	}
+
+	// while the list is being fetched again the old one is used, and only
+	// one fetch is made however many tokens are checked
+	lock.Lock()
+	block = make(chan struct{})
+	lock.Unlock()
+	v.Lock()
+	v.withdrawnFetched = time.Now().Add(-withdrawnTTL - time.Second)
+	v.Unlock()
+	done := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			principal, err := v.verify(token)
+			if err == nil && principal == nil {
+				err = errors.New("token refused")
+			}
+			done <- err
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("expected the token to be valid with the old list, got %s", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected tokens to be checked without waiting for the list")
+		}
+	}
+	lock.Lock()
+	close(block)
+	block = nil
+	lock.Unlock()
+	for i := 0; ; i++ {
+		v.Lock()
+		refreshed := v.withdrawnRefresh == nil
+		v.Unlock()
+		if refreshed {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("expected the list to be fetched once it was let through")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lock.Lock()
+	if fetches != 2 {
+		t.Fatalf("expected the list to be fetched once more, it was fetched %d times", fetches)
+	}
+	failing = true
+	lock.Unlock()
+
+	// a list that's too old isn't trusted, so the auth server is asked
+	v.Lock()
+	v.withdrawnFetched = time.Now().Add(-withdrawnTTL - withdrawnMaxStale - time.Second)
+	v.Unlock()
+	if _, err := v.verify(token); err == nil {
+		t.Fatalf("expected an error checking a token with a list that is too old")
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	// keyRefreshInterval is the least time between fetching the auth
+	// server's keys, so tokens with unknown key IDs can't be used to make
+	// us fetch them over and over
+	keyRefreshInterval = time.Minute
+
+	// withdrawnTTL is how long the list of withdrawn tokens is used before
+	// it is fetched again, and so how long a revoked signed token may still
+	// be accepted
+	withdrawnTTL = 30 * time.Second
+
+	// withdrawnMaxStale is how much longer the last list fetched is used
+	// while a newer one can't be, before signed tokens are left to the auth
+	// server to check instead
+	withdrawnMaxStale = 5 * time.Minute
+)
+
+var errUnknownKey = errors.New("signed with an unknown key")
+
+// signedHeader is the header of a signed token
+type signedHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// signedClaims are what a signed token says about itself
+type signedClaims struct {
+	ID        string `json:"jti"`
+	Scope     string `json:"scope"`
+	NotBefore int64  `json:"nbf"`
+	Expires   int64  `json:"exp"`
+}
+
+// keySet is the auth server's public keys, as a JSON Web Key set
+type keySet struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Kid string `json:"kid"`
+	} `json:"keys"`
+}
+
+// withdrawnList is the auth server's list of signed tokens that stop being
+// valid before they expire
+type withdrawnList struct {
+	Withdrawn []struct {
+		ID    string
+		Until time.Time
+	}
+}
+
+// refresh is a fetch from the auth server. Only one of each kind is made at
+// a time, and whoever needs its result waits on done.
+type refresh struct {
+	done chan struct{}
+	err  error
+}
+
+// signedTokens checks tokens signed by the auth server without asking it
+// about each one. The auth server's keys and the tokens it has withdrawn are
+// fetched from it as they are needed, without holding the lock, so that
+// tokens that can be checked with what is already known don't wait on it.
+type signedTokens struct {
+	sync.Mutex
+	authaddr string
+	client   *http.Client
+
+	keys          map[string]ed25519.PublicKey
+	keysAttempted time.Time
+	keysRefresh   *refresh
+
+	withdrawn        map[string]time.Time
+	withdrawnFetched time.Time
+	withdrawnRefresh *refresh
+}
+
+func newSignedTokens(authaddr string, client *http.Client) *signedTokens {
+	return &signedTokens{authaddr: authaddr, client: client}
+}
+
+// looksSigned returns true if the token has the three parts of a signed
+// token, and so is worth checking locally
+func looksSigned(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// verify checks the signed token, returning who it belongs to or nil if it
+// is forged, expired or withdrawn. An error means it couldn't be checked
+// here, and the auth server should be asked instead.
+func (v *signedTokens) verify(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	header := &signedHeader{}
+	claims := &signedClaims{}
+	if err := decodeSegment(parts[0], header); err != nil {
+		return nil, err
+	}
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	if header.Alg != "EdDSA" {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(key, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, nil
+	}
+
+	now := time.Now()
+	if now.Unix() >= claims.Expires || now.Unix() < claims.NotBefore {
+		return nil, nil
+	}
+	withdrawn, err := v.isWithdrawn(claims.ID, now)
+	if err != nil || withdrawn {
+		return nil, err
+	}
+	id, _ := strconv.ParseInt(claims.ID, 10, 64)
+	return &Principal{Token: token, ID: id, Scopes: strings.Fields(claims.Scope)}, nil
+}
+
+// startRefresh calls fetch in the background unless a refresh of the same
+// kind is already in flight, and returns the refresh to wait on. It must be
+// called with the lock held.
+func (v *signedTokens) startRefresh(inFlight **refresh, fetch func() error) *refresh {
+	if *inFlight != nil {
+		return *inFlight
+	}
+	r := &refresh{done: make(chan struct{})}
+	*inFlight = r
+	go func() {
+		err := fetch()
+		v.Lock()
+		r.err = err
+		*inFlight = nil
+		v.Unlock()
+		close(r.done)
+	}()
+	return r
+}
+
+// key returns the public key with the ID, fetching the auth server's keys if
+// it isn't known yet
+func (v *signedTokens) key(kid string) (ed25519.PublicKey, error) {
+	v.Lock()
+	if key, ok := v.keys[kid]; ok {
+		v.Unlock()
+		return key, nil
+	}
+	if v.keysRefresh == nil {
+		if time.Since(v.keysAttempted) < keyRefreshInterval {
+			v.Unlock()
+			return nil, errUnknownKey
+		}
+		v.keysAttempted = time.Now()
+	}
+	r := v.startRefresh(&v.keysRefresh, v.fetchKeys)
+	v.Unlock()
+
+	<-r.done
+	if r.err != nil {
+		return nil, r.err
+	}
+	v.Lock()
+	defer v.Unlock()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, errUnknownKey
+}
+
+// fetchKeys fetches the auth server's keys
+func (v *signedTokens) fetchKeys() error {
+	set := &keySet{}
+	if err := getJSON(v.client, v.authaddr+"/.well-known/jwks.json", set); err != nil {
+		return err
+	}
+	keys := make(map[string]ed25519.PublicKey)
+	for _, k := range set.Keys {
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Kty != "OKP" || k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			continue
+		}
+		keys[k.Kid] = ed25519.PublicKey(x)
+	}
+	v.Lock()
+	v.keys = keys
+	v.Unlock()
+	return nil
+}
+
+// isWithdrawn returns true if the token with the ID has been withdrawn. Once
+// the list of withdrawn tokens is out of date a new one is fetched in the
+// background, and the old one is used until it arrives, for up to
+// withdrawnMaxStale. Past that, or before there is a list, the new one is
+// waited for.
+func (v *signedTokens) isWithdrawn(id string, now time.Time) (bool, error) {
+	v.Lock()
+	if age := now.Sub(v.withdrawnFetched); age >= withdrawnTTL {
+		r := v.startRefresh(&v.withdrawnRefresh, v.fetchWithdrawn)
+		if v.withdrawn == nil || age >= withdrawnTTL+withdrawnMaxStale {
+			v.Unlock()
+			<-r.done
+			if r.err != nil {
+				return false, r.err
+			}
+			v.Lock()
+		}
+	}
+	until, ok := v.withdrawn[id]
+	v.Unlock()
+	return ok && !now.Before(until), nil
+}
+
+// fetchWithdrawn fetches the list of withdrawn tokens
+func (v *signedTokens) fetchWithdrawn() error {
+	list := &withdrawnList{}
+	if err := getJSON(v.client, v.authaddr+"/.well-known/revoked.json", list); err != nil {
+		fmt.Println("couldn't fetch the withdrawn signed tokens: ", err)
+		return err
+	}
+	withdrawn := make(map[string]time.Time)
+	for _, w := range list.Withdrawn {
+		withdrawn[w.ID] = w.Until
+	}
+	v.Lock()
+	v.withdrawn = withdrawn
+	v.withdrawnFetched = time.Now()
+	v.Unlock()
+	return nil
+}
+
+// decodeSegment decodes one base64 encoded JSON part of a signed token
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// getJSON fetches the URL with the client and decodes the JSON response into v
+func getJSON(client *http.Client, url string, v interface{}) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,449 @@
+// Package config loads the settings of the quotivational programs. Every
+// setting is a command line flag, and may also be given in an environment
+// variable or a config file. The command line beats the environment, which
+// beats the config file, which beats the flag's default.
+package config
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Where a setting came from, when not the environment or the config file
+const (
+	sourceDefault = "default"
+	sourceFlag    = "command line"
+)
+
+// Options describes where a program looks for its settings
+type Options struct {
+	// EnvPrefix prefixes the environment variable of each setting, which is
+	// the flag name in upper case with dashes as underscores. With the prefix
+	// SERVER, -redis-max-idle is read from $SERVER_REDIS_MAX_IDLE.
+	EnvPrefix string
+
+	// Env names the environment variables of settings that don't follow that
+	// pattern, by flag name
+	Env map[string]string
+
+	// DefaultFile is the config file read when none is given. Unlike one that
+	// is given, it doesn't have to exist.
+	DefaultFile string
+
+	// Secret names the settings whose values -print-config doesn't show
+	Secret []string
+}
+
+// Repeatable is a flag value that may be given more than once. In the config
+// file it takes a list, and in the environment comma separated values.
+type Repeatable interface {
+	flag.Value
+	Values() []string
+}
+
+// Strings is a flag value collecting the strings it is given
+type Strings []string
+
+// String returns the strings separated by commas
+func (s *Strings) String() string {
+	return strings.Join(*s, ",")
+}
+
+// Set adds a string
+func (s *Strings) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// Values returns the strings
+func (s *Strings) Values() []string {
+	return *s
+}
+
+// Config is the settings a program was given, and where each came from
+type Config struct {
+	flags   *flag.FlagSet
+	options Options
+	file    string
+	print   bool
+	sources map[string]string
+}
+
+// Load adds the -config and -print-config flags to the flags and parses the
+// command line args into them. Flags that weren't given on the command line
+// are then set from the environment, or failing that the config file.
+func Load(flags *flag.FlagSet, args []string, options Options) (*Config, error) {
+	c := &Config{flags: flags, options: options, sources: make(map[string]string)}
+	fileUsage := "A config file of settings, one per line as name = value, named as the flags are. " +
+		"Defaults to $" + c.envName("config")
+	if options.DefaultFile != "" {
+		fileUsage += " or " + options.DefaultFile
+	}
+	flags.StringVar(&c.file, "config", "", fileUsage)
+	flags.BoolVar(&c.print, "print-config", false,
+		"Print the settings, and where each came from, as a config file and exit")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	flags.Visit(func(f *flag.Flag) {
+		c.sources[f.Name] = sourceFlag
+	})
+
+	mustExist := true
+	if c.sources["config"] == "" {
+		if env := c.envName("config"); os.Getenv(env) != "" {
+			c.file = os.Getenv(env)
+			c.sources["config"] = "$" + env
+		} else {
+			c.file = options.DefaultFile
+			mustExist = false
+		}
+	}
+	var settings map[string][]string
+	if c.file != "" {
+		var err error
+		settings, err = readFile(c.file)
+		if os.IsNotExist(err) && !mustExist {
+			c.file = ""
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	for name := range settings {
+		if f := flags.Lookup(name); f == nil || name == "config" || name == "print-config" {
+			return nil, fmt.Errorf("%s: unknown setting %q", c.file, name)
+		}
+	}
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" || f.Name == "print-config" || c.sources[f.Name] != "" {
+			return
+		}
+		env := c.envName(f.Name)
+		if value := os.Getenv(env); value != "" {
+			values := []string{value}
+			if _, ok := f.Value.(Repeatable); ok {
+				values = strings.Split(value, ",")
+				for i := range values {
+					values[i] = strings.TrimSpace(values[i])
+				}
+			}
+			err = c.set(f, values, "$"+env)
+		} else if values, ok := settings[f.Name]; ok {
+			err = c.set(f, values, c.file)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// set sets the flag to the values, recording where they came from
+func (c *Config) set(f *flag.Flag, values []string, source string) error {
+	if _, ok := f.Value.(Repeatable); !ok && len(values) != 1 {
+		return fmt.Errorf("%s from %s takes a single value, not a list", f.Name, source)
+	}
+	for _, value := range values {
+		if err := f.Value.Set(value); err != nil {
+			return fmt.Errorf("invalid value %q for %s from %s: %s", value, f.Name, source, err)
+		}
+	}
+	c.sources[f.Name] = source
+	return nil
+}
+
+// envName returns the environment variable a setting is read from
+func (c *Config) envName(name string) string {
+	if env, ok := c.options.Env[name]; ok {
+		return env
+	}
+	env := strings.ToUpper(strings.Replace(name, "-", "_", -1))
+	if c.options.EnvPrefix != "" {
+		env = c.options.EnvPrefix + "_" + env
+	}
+	return env
+}
+
+// File returns the config file the settings were read from, if there was one
+func (c *Config) File() string {
+	return c.file
+}
+
+// Source returns where a setting came from: the command line, the
+// environment variable it was read from, the config file or the default
+func (c *Config) Source(name string) string {
+	if source := c.sources[name]; source != "" {
+		return source
+	}
+	return sourceDefault
+}
+
+// Overridden returns true if a setting came from the command line or the
+// environment, so that changing it in the config file won't change it
+func (c *Config) Overridden(name string) bool {
+	source := c.sources[name]
+	return source != "" && source != c.file
+}
+
+// PrintRequested returns true if -print-config was given, in which case the
+// program should Print its settings and exit
+func (c *Config) PrintRequested() bool {
+	return c.print
+}
+
+// Require returns an error for the first of the named settings that isn't
+// set, saying how it can be
+func (c *Config) Require(names ...string) error {
+	for _, name := range names {
+		if f := c.flags.Lookup(name); f == nil || f.Value.String() == "" {
+			return fmt.Errorf("%s is required: set it with -%s, $%s or in a config file",
+				name, name, c.envName(name))
+		}
+	}
+	return nil
+}
+
+// Print writes the settings in the form of a config file, commenting on where
+// each came from. Secret settings are commented out, without their values.
+func (c *Config) Print(w io.Writer) {
+	file := c.file
+	if file == "" {
+		file = "none"
+	}
+	prefix := "the environment"
+	if c.options.EnvPrefix != "" {
+		prefix = "$" + c.options.EnvPrefix + "_*"
+	}
+	fmt.Fprintln(w, "# Settings are taken from, in order of precedence:")
+	fmt.Fprintln(w, "#   1. the command line")
+	fmt.Fprintf(w, "#   2. %s\n", prefix)
+	fmt.Fprintf(w, "#   3. the config file (%s)\n", file)
+	fmt.Fprintln(w, "#   4. defaults")
+
+	secret := make(map[string]bool)
+	for _, name := range c.options.Secret {
+		secret[name] = true
+	}
+	c.flags.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+		source := c.Source(f.Name)
+		switch {
+		case secret[f.Name] && f.Value.String() != "":
+			fmt.Fprintf(w, "# %s is set but secret  # %s\n", f.Name, source)
+		case secret[f.Name]:
+			fmt.Fprintf(w, "# %s is not set\n", f.Name)
+		default:
+			fmt.Fprintf(w, "%s = %s  # %s\n", f.Name, formatValue(f.Value), source)
+		}
+	})
+}
+
+// formatValue returns the flag's value as it would be written in a config
+// file
+func formatValue(value flag.Value) string {
+	if r, ok := value.(Repeatable); ok {
+		quoted := []string{}
+		for _, v := range r.Values() {
+			quoted = append(quoted, strconv.Quote(v))
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	}
+	s := value.String()
+	if _, err := strconv.ParseFloat(s, 64); err == nil || s == "true" || s == "false" {
+		return s
+	}
+	return strconv.Quote(s)
+}
+
+// Setting is a setting to write to a config file
+type Setting struct {
+	Name  string
+	Value string
+}
+
+// WriteFile writes the settings to a config file that only its owner can
+// read, since settings may be secret. The file is replaced rather than
+// rewritten, so it's never left half written.
+func WriteFile(path string, settings []Setting) error {
+	var lines []string
+	for _, s := range settings {
+		lines = append(lines, formatSetting(s))
+	}
+	return writeLines(path, lines)
+}
+
+// UpdateFile is WriteFile for only some settings, leaving the rest of the
+// file, comments included, as it was. A file that doesn't exist is created.
+func UpdateFile(path string, settings []Setting) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	pending := make(map[string]Setting)
+	for _, s := range settings {
+		pending[s.Name] = s
+	}
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+	for i, line := range lines {
+		text := strings.TrimSpace(line)
+		eq := strings.Index(text, "=")
+		if text == "" || text[0] == '#' || eq < 1 {
+			continue
+		}
+		if s, ok := pending[strings.TrimSpace(text[:eq])]; ok {
+			lines[i] = formatSetting(s)
+			delete(pending, s.Name)
+		}
+	}
+	for _, s := range settings {
+		if _, ok := pending[s.Name]; ok {
+			lines = append(lines, formatSetting(s))
+		}
+	}
+	return writeLines(path, lines)
+}
+
+// formatSetting returns the line of a config file holding the setting
+func formatSetting(s Setting) string {
+	return fmt.Sprintf("%s = %s", s.Name, strconv.Quote(s.Value))
+}
+
+// writeLines replaces the file with one holding the lines, which only its
+// owner can read
+func writeLines(path string, lines []string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	err = f.Chmod(0600)
+	for _, line := range lines {
+		if err != nil {
+			break
+		}
+		_, err = fmt.Fprintln(f, line)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// readFile reads the settings in a config file, which holds one per line as
+// name = value. It is a subset of TOML: values are strings, numbers, booleans
+// or single line lists of them, and tables aren't supported.
+func readFile(path string) (map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	settings := make(map[string][]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		if text[0] == '[' {
+			return nil, fmt.Errorf("%s:%d: tables aren't supported", path, line)
+		}
+		i := strings.Index(text, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("%s:%d: expected name = value", path, line)
+		}
+		name := strings.TrimSpace(text[:i])
+		if _, ok := settings[name]; ok {
+			return nil, fmt.Errorf("%s:%d: %s is set more than once", path, line, name)
+		}
+		values, err := parseValue(strings.TrimSpace(text[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		settings[name] = values
+	}
+	return settings, scanner.Err()
+}
+
+// parseValue parses a value, or a list of them, and the comment after it
+func parseValue(s string) ([]string, error) {
+	var values []string
+	list := strings.HasPrefix(s, "[")
+	if list {
+		s = strings.TrimSpace(s[1:])
+	}
+	for {
+		if list && strings.HasPrefix(s, "]") {
+			s = s[1:]
+			break
+		}
+		value, rest, err := parseScalar(s)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		s = strings.TrimSpace(rest)
+		if !list {
+			break
+		}
+		if strings.HasPrefix(s, ",") {
+			s = strings.TrimSpace(s[1:])
+		} else if !strings.HasPrefix(s, "]") {
+			return nil, fmt.Errorf("expected , or ] in list")
+		}
+	}
+	if s = strings.TrimSpace(s); s != "" && s[0] != '#' {
+		return nil, fmt.Errorf("unexpected %q after value", s)
+	}
+	return values, nil
+}
+
+// parseScalar parses a single value at the start of s, returning the rest
+func parseScalar(s string) (string, string, error) {
+	switch {
+	case s == "":
+		return "", "", fmt.Errorf("missing value")
+	case s[0] == '"':
+		for i := 1; i < len(s); i++ {
+			if s[i] == '\\' {
+				i++
+			} else if s[i] == '"' {
+				value, err := strconv.Unquote(s[:i+1])
+				if err != nil {
+					return "", "", fmt.Errorf("invalid string %s", s[:i+1])
+				}
+				return value, s[i+1:], nil
+			}
+		}
+		return "", "", fmt.Errorf("unterminated string")
+	case s[0] == '\'':
+		i := strings.Index(s[1:], "'")
+		if i < 0 {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		return s[1 : i+1], s[i+2:], nil
+	}
+	end := strings.IndexAny(s, " \t#,]")
+	if end < 0 {
+		end = len(s)
+	}
+	return s[:end], s[end:], nil
+}
@@ -0,0 +1,312 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFlags is a flag set with a setting of each kind
+type testFlags struct {
+	flags  *flag.FlagSet
+	name   *string
+	count  *int
+	wait   *time.Duration
+	secret *string
+	list   Strings
+}
+
+func newTestFlags() *testFlags {
+	f := &testFlags{flags: flag.NewFlagSet("test", flag.ContinueOnError)}
+	f.flags.SetOutput(ioutil.Discard)
+	f.name = f.flags.String("name", "default", "")
+	f.count = f.flags.Int("count", 1, "")
+	f.wait = f.flags.Duration("wait-time", time.Second, "")
+	f.secret = f.flags.String("secret", "", "")
+	f.flags.Var(&f.list, "item", "")
+	return f
+}
+
+// writeConfig writes a config file to a temp dir, returning its path
+func writeConfig(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("unable to create tempdir: %s", err)
+	}
+	path := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("unable to write config: %s", err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+// setEnv sets environment variables, returning a function that unsets them
+func setEnv(vars map[string]string) func() {
+	for name, value := range vars {
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name := range vars {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	path, cleanup := writeConfig(t, `
+# settings for the test
+name = "from file"  # a comment
+count = 3
+wait-time = '5s'
+item = ["a", "b # not a comment"]
+`)
+	defer cleanup()
+	defer setEnv(map[string]string{"TEST_COUNT": "4", "TEST_WAIT_TIME": "6s"})()
+
+	f := newTestFlags()
+	c, err := Load(f.flags, []string{"-config", path, "-wait-time", "7s", "arg"}, Options{EnvPrefix: "TEST"})
+	if err != nil {
+		t.Fatalf("expected no error loading, got %s", err)
+	}
+	if *f.name != "from file" {
+		t.Fatalf("expected name from the file, got %q", *f.name)
+	}
+	if *f.count != 4 {
+		t.Fatalf("expected count from the environment over the file, got %d", *f.count)
+	}
+	if *f.wait != 7*time.Second {
+		t.Fatalf("expected wait-time from the command line over the environment, got %s", *f.wait)
+	}
+	if !reflect.DeepEqual([]string(f.list), []string{"a", "b # not a comment"}) {
+		t.Fatalf("expected the list from the file, got %v", f.list)
+	}
+	if *f.secret != "" {
+		t.Fatalf("expected secret to keep its default, got %q", *f.secret)
+	}
+	if f.flags.NArg() != 1 || f.flags.Arg(0) != "arg" {
+		t.Fatalf("expected the arguments to be left, got %v", f.flags.Args())
+	}
+	if c.File() != path {
+		t.Fatalf("expected the config file to be %s, got %s", path, c.File())
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	defer setEnv(map[string]string{"TEST_ITEM": "a, b", "OTHER_NAME": "renamed"})()
+
+	f := newTestFlags()
+	_, err := Load(f.flags, nil, Options{EnvPrefix: "TEST", Env: map[string]string{"name": "OTHER_NAME"}})
+	if err != nil {
+		t.Fatalf("expected no error loading, got %s", err)
+	}
+	if !reflect.DeepEqual([]string(f.list), []string{"a", "b"}) {
+		t.Fatalf("expected a list split on commas, got %v", f.list)
+	}
+	if *f.name != "renamed" {
+		t.Fatalf("expected name from its own environment variable, got %q", *f.name)
+	}
+}
+
+func TestConfigFileFromEnvironment(t *testing.T) {
+	path, cleanup := writeConfig(t, "name = from-env-file\n")
+	defer cleanup()
+	defer setEnv(map[string]string{"TEST_CONFIG": path})()
+
+	f := newTestFlags()
+	if _, err := Load(f.flags, nil, Options{EnvPrefix: "TEST"}); err != nil {
+		t.Fatalf("expected no error loading, got %s", err)
+	}
+	if *f.name != "from-env-file" {
+		t.Fatalf("expected name from the file in $TEST_CONFIG, got %q", *f.name)
+	}
+}
+
+func TestMissingConfigFile(t *testing.T) {
+	missing := filepath.Join(os.TempDir(), "no-such-dir", "config")
+
+	f := newTestFlags()
+	c, err := Load(f.flags, nil, Options{EnvPrefix: "TEST", DefaultFile: missing})
+	if err != nil {
+		t.Fatalf("expected a missing default file to be fine, got %s", err)
+	}
+	if c.File() != "" {
+		t.Fatalf("expected no config file, got %s", c.File())
+	}
+
+	f = newTestFlags()
+	if _, err := Load(f.flags, []string{"-config", missing}, Options{EnvPrefix: "TEST"}); err == nil {
+		t.Fatalf("expected an error for a missing config file that was asked for")
+	}
+}
+
+func TestInvalidSettings(t *testing.T) {
+	for _, c := range []struct {
+		contents string
+		expected string
+	}{
+		{"nope = 1\n", `unknown setting "nope"`},
+		{"count = many\n", `invalid value "many" for count from`},
+		{"name = [\"a\", \"b\"]\n", "name from"},
+		{"name = \"unterminated\n", ":1: unterminated string"},
+		{"\n[table]\n", ":2: tables aren't supported"},
+		{"count = 1\ncount = 2\n", ":2: count is set more than once"},
+		{"name = a b\n", `:1: unexpected "b" after value`},
+	} {
+		path, cleanup := writeConfig(t, c.contents)
+		f := newTestFlags()
+		_, err := Load(f.flags, []string{"-config", path}, Options{EnvPrefix: "TEST"})
+		cleanup()
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Fatalf("expected an error containing %q for %q, got %v", c.expected, c.contents, err)
+		}
+	}
+
+	defer setEnv(map[string]string{"TEST_COUNT": "lots"})()
+	f := newTestFlags()
+	_, err := Load(f.flags, nil, Options{EnvPrefix: "TEST"})
+	if err == nil || !strings.Contains(err.Error(), "from $TEST_COUNT") {
+		t.Fatalf("expected an error naming the environment variable, got %v", err)
+	}
+}
+
+func TestRequire(t *testing.T) {
+	f := newTestFlags()
+	c, err := Load(f.flags, []string{"-name", "set"}, Options{EnvPrefix: "TEST"})
+	if err != nil {
+		t.Fatalf("expected no error loading, got %s", err)
+	}
+	if err := c.Require("name"); err != nil {
+		t.Fatalf("expected name to be set, got %s", err)
+	}
+	err = c.Require("name", "secret")
+	if err == nil || !strings.Contains(err.Error(), "-secret, $TEST_SECRET") {
+		t.Fatalf("expected an error saying how to set secret, got %v", err)
+	}
+}
+
+func TestPrint(t *testing.T) {
+	path, cleanup := writeConfig(t, "name = \"from file\"\nitem = [\"a\"]\n")
+	defer cleanup()
+	defer setEnv(map[string]string{"TEST_SECRET": "hunter2"})()
+
+	f := newTestFlags()
+	c, err := Load(f.flags, []string{"-print-config", "-config", path, "-count", "2"},
+		Options{EnvPrefix: "TEST", Secret: []string{"secret"}})
+	if err != nil {
+		t.Fatalf("expected no error loading, got %s", err)
+	}
+	if !c.PrintRequested() {
+		t.Fatalf("expected printing to be requested")
+	}
+	out := &bytes.Buffer{}
+	c.Print(out)
+	printed := out.String()
+	for _, expected := range []string{
+		"config file (" + path + ")",
+		"count = 2  # command line\n",
+		`item = ["a"]  # ` + path + "\n",
+		`name = "from file"  # ` + path + "\n",
+		"# secret is set but secret  # $TEST_SECRET\n",
+		`wait-time = "1s"  # default` + "\n",
+	} {
+		if !strings.Contains(printed, expected) {
+			t.Fatalf("expected the settings printed to contain %q, got:\n%s", expected, printed)
+		}
+	}
+	if strings.Contains(printed, "hunter2") {
+		t.Fatalf("expected secrets not to be printed, got:\n%s", printed)
+	}
+}
+
+func TestSource(t *testing.T) {
+	path, cleanup := writeConfig(t, "name = \"from file\"\ncount = 3\n")
+	defer cleanup()
+	defer setEnv(map[string]string{"TEST_COUNT": "4"})()
+
+	f := newTestFlags()
+	c, err := Load(f.flags, []string{"-config", path, "-wait-time", "2s"}, Options{EnvPrefix: "TEST"})
+	if err != nil {
+		t.Fatalf("expected no error loading, got %s", err)
+	}
+	for _, expected := range []struct {
+		name       string
+		source     string
+		overridden bool
+	}{
+		{"name", path, false},
+		{"count", "$TEST_COUNT", true},
+		{"wait-time", "command line", true},
+		{"secret", "default", false},
+	} {
+		if source := c.Source(expected.name); source != expected.source {
+			t.Fatalf("expected %s to come from %s, got %s", expected.name, expected.source, source)
+		}
+		if c.Overridden(expected.name) != expected.overridden {
+			t.Fatalf("expected %s overridden to be %v", expected.name, expected.overridden)
+		}
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	path, cleanup := writeConfig(t, "name = old\n")
+	defer cleanup()
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := WriteFile(path, []Setting{{"name", `a "quoted" name`}, {"secret", "hunter2"}})
+	if err != nil {
+		t.Fatalf("expected no error writing settings, got %s", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("expected the config file to exist, got %s", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected only the owner to be able to read the config file, got %s", info.Mode())
+	}
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected only the config file to be left, got %v, %v", files, err)
+	}
+
+	f := newTestFlags()
+	if _, err := Load(f.flags, []string{"-config", path}, Options{EnvPrefix: "TEST"}); err != nil {
+		t.Fatalf("expected no error loading the settings written, got %s", err)
+	}
+	if *f.name != `a "quoted" name` || *f.secret != "hunter2" {
+		t.Fatalf("expected the settings written to be read back, got %q and %q", *f.name, *f.secret)
+	}
+}
+
+func TestUpdateFile(t *testing.T) {
+	path, cleanup := writeConfig(t, "# my settings\nname = old  # keep this short\nsecret = \"hunter2\"\n")
+	defer cleanup()
+
+	if err := UpdateFile(path, []Setting{{"name", "new"}, {"count", "5"}}); err != nil {
+		t.Fatalf("expected no error updating settings, got %s", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "# my settings\nname = \"new\"\nsecret = \"hunter2\"\ncount = \"5\"\n"
+	if string(data) != expected {
+		t.Fatalf("expected only the settings given to change, got:\n%s", data)
+	}
+
+	missing := filepath.Join(filepath.Dir(path), "missing")
+	if err := UpdateFile(missing, []Setting{{"name", "new"}}); err != nil {
+		t.Fatalf("expected a missing file to be created, got %s", err)
+	}
+	f := newTestFlags()
+	if _, err := Load(f.flags, []string{"-config", missing}, Options{}); err != nil || *f.name != "new" {
+		t.Fatalf("expected the setting to be read back, got %q, %v", *f.name, err)
+	}
+}
@@ -16,7 +16,8 @@ CREATE TABLE `quote` (
 	`created` DATETIME DEFAULT CURRENT_TIMESTAMP,
 	`updated` DATETIME DEFAULT CURRENT_TIMESTAMP,
 	PRIMARY KEY (`id`),
-	UNIQUE KEY `quote`  (`author`, `text`)
+	UNIQUE KEY `quote`  (`author`, `text`),
+	FULLTEXT KEY `text_fulltext` (`text`)
 );
 
 INSERT INTO `quote` (`topic`, `author`, `text`) VALUES
@@ -0,0 +1,257 @@
+// Package serve serves the quotivational programs' HTTP handlers, with
+// timeouts, optional TLS and a graceful shutdown.
+package serve
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Serving defaults
+const (
+	defaultReadTimeout     = 10 * time.Second
+	defaultWriteTimeout    = 30 * time.Second
+	defaultIdleTimeout     = 2 * time.Minute
+	defaultShutdownTimeout = 30 * time.Second
+
+	// drainPollInterval is how often shutdown checks whether the requests
+	// in flight have finished
+	drainPollInterval = 100 * time.Millisecond
+)
+
+// Config configures how a server listens and shuts down
+type Config struct {
+	Addr string
+
+	// ReadTimeout and WriteTimeout bound reading a request and writing its
+	// response, and IdleTimeout is how long a keep-alive connection is kept
+	// open waiting for the next request
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// ShutdownTimeout is how long requests in flight are given to finish
+	// once the server is told to stop
+	ShutdownTimeout time.Duration
+
+	// TLSCert and TLSKey are files holding the certificate and key to serve
+	// HTTPS with. Without them the server serves plain HTTP.
+	TLSCert string
+	TLSKey  string
+
+	// ClientCA is a file holding the CA certificates that clients must
+	// present a certificate signed by. It needs TLSCert and TLSKey.
+	ClientCA string
+}
+
+// RegisterFlags adds flags for the configuration to the flag set
+func (c *Config) RegisterFlags(flags *flag.FlagSet, defaultAddr string) {
+	flags.StringVar(&c.Addr, "listen", defaultAddr, "The address to listen on")
+	flags.DurationVar(&c.ReadTimeout, "read-timeout", defaultReadTimeout, "How long reading a request may take")
+	flags.DurationVar(&c.WriteTimeout, "write-timeout", defaultWriteTimeout, "How long writing a response may take")
+	flags.DurationVar(&c.IdleTimeout, "idle-timeout", defaultIdleTimeout, "How long an idle connection is kept open")
+	flags.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", defaultShutdownTimeout,
+		"How long requests in flight may take to finish when stopping")
+	flags.StringVar(&c.TLSCert, "tls-cert", "", "A certificate file to serve HTTPS with")
+	flags.StringVar(&c.TLSKey, "tls-key", "", "The key file for -tls-cert")
+	flags.StringVar(&c.ClientCA, "tls-client-ca", "",
+		"A CA certificate file that clients must present a certificate signed by")
+}
+
+// LoadCertPool reads the PEM encoded certificates in the file
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// TLSConfig returns the TLS configuration to serve with, or nil to serve
+// plain HTTP
+func (c *Config) TLSConfig() (*tls.Config, error) {
+	if c.TLSCert == "" && c.TLSKey == "" {
+		if c.ClientCA != "" {
+			return nil, errors.New("a client CA needs a TLS certificate and key")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if c.ClientCA != "" {
+		config.ClientCAs, err = LoadCertPool(c.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// connTracker keeps track of the server's connections, so that idle ones
+// can be closed after a while and when shutting down
+type connTracker struct {
+	sync.Mutex
+	idleTimeout time.Duration
+	conns       map[net.Conn]http.ConnState
+	idleTimers  map[net.Conn]*time.Timer
+	draining    bool
+}
+
+func newConnTracker(idleTimeout time.Duration) *connTracker {
+	return &connTracker{
+		idleTimeout: idleTimeout,
+		conns:       make(map[net.Conn]http.ConnState),
+		idleTimers:  make(map[net.Conn]*time.Timer),
+	}
+}
+
+// connState is the server's ConnState hook
+func (t *connTracker) connState(c net.Conn, state http.ConnState) {
+	t.Lock()
+	defer t.Unlock()
+	if timer, ok := t.idleTimers[c]; ok {
+		timer.Stop()
+		delete(t.idleTimers, c)
+	}
+	switch state {
+	case http.StateNew, http.StateActive:
+		t.conns[c] = state
+	case http.StateIdle:
+		t.conns[c] = state
+		if t.draining {
+			c.Close()
+		} else if t.idleTimeout > 0 {
+			t.idleTimers[c] = time.AfterFunc(t.idleTimeout, func() { c.Close() })
+		}
+	case http.StateHijacked, http.StateClosed:
+		delete(t.conns, c)
+	}
+}
+
+// drain closes idle connections, and those that become idle from now on,
+// and waits up to timeout for the rest to finish their requests before
+// closing them too. It returns false if it had to close any that were busy.
+func (t *connTracker) drain(timeout time.Duration) bool {
+	t.Lock()
+	t.draining = true
+	for c, state := range t.conns {
+		if state == http.StateIdle {
+			c.Close()
+		}
+	}
+	t.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		t.Lock()
+		n := len(t.conns)
+		t.Unlock()
+		if n == 0 {
+			return true
+		}
+		time.Sleep(drainPollInterval)
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	for c := range t.conns {
+		c.Close()
+	}
+	return false
+}
+
+// Serve serves the handler as configured until stop is closed, then stops
+// accepting connections and lets the requests in flight finish before
+// returning. An error is returned if the server can't listen.
+func Serve(handler http.Handler, config Config, stop <-chan struct{}) error {
+	tlsConfig, err := config.TLSConfig()
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		return err
+	}
+	return OnListener(tcpKeepAliveListener{listener.(*net.TCPListener)}, handler, config, tlsConfig, stop)
+}
+
+// OnListener is Serve on a listener that's already open
+func OnListener(listener net.Listener, handler http.Handler, config Config,
+	tlsConfig *tls.Config, stop <-chan struct{}) error {
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	tracker := newConnTracker(config.IdleTimeout)
+	server := &http.Server{
+		Handler:      handler,
+		ReadTimeout:  config.ReadTimeout,
+		WriteTimeout: config.WriteTimeout,
+		ConnState:    tracker.connState,
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-stop:
+	}
+	server.SetKeepAlivesEnabled(false)
+	listener.Close()
+	if !tracker.drain(config.ShutdownTimeout) {
+		fmt.Println("gave up waiting for requests to finish")
+	}
+	return nil
+}
+
+// tcpKeepAliveListener sets TCP keep-alives on accepted connections, as
+// http.ListenAndServe does, so dead peers are eventually noticed
+type tcpKeepAliveListener struct {
+	*net.TCPListener
+}
+
+func (l tcpKeepAliveListener) Accept() (net.Conn, error) {
+	c, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	c.SetKeepAlive(true)
+	c.SetKeepAlivePeriod(3 * time.Minute)
+	return c, nil
+}
+
+// StopOnSignal returns a channel that is closed when the process is told to
+// stop with SIGTERM or SIGINT
+func StopOnSignal() <-chan struct{} {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	stop := make(chan struct{})
+	go func() {
+		sig := <-signals
+		fmt.Println("received ", sig, ", shutting down")
+		close(stop)
+	}()
+	return stop
+}
@@ -0,0 +1,68 @@
+package serve
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServeDrainsRequestsOnStop(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected no error listening: %s", err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+	stop := make(chan struct{})
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- OnListener(listener, handler, Config{ShutdownTimeout: 5 * time.Second}, nil, stop)
+	}()
+
+	url := "http://" + listener.Addr().String()
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Errorf("expected the request in flight to finish, got %s", err)
+			close(responses)
+			return
+		}
+		responses <- resp
+	}()
+	<-started
+	close(stop)
+
+	select {
+	case <-stopped:
+		t.Fatalf("expected the server to wait for the request in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := net.DialTimeout("tcp", listener.Addr().String(), time.Second); err == nil {
+		t.Fatalf("expected new connections to be refused while stopping")
+	}
+
+	close(release)
+	if resp, ok := <-responses; ok {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "done" {
+			t.Fatalf("expected the request in flight to be answered, got %q", body)
+		}
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("expected no error stopping, got %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the server to stop once the request was done")
+	}
+}